@@ -3,26 +3,39 @@ package main
 import (
 	"context"
 	"database/sql"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/sirupsen/logrus"
 
+	"github.com/gobulgur/kafka-serves/pkg/config"
 	"github.com/gobulgur/kafka-serves/pkg/kafka"
 	"github.com/gobulgur/kafka-serves/services/billing"
 )
 
 func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "путь к YAML-файлу конфигурации")
+	flag.Parse()
+
+	// Загружаем конфигурацию: YAML-файл, поверх него переменные окружения
+	cfg, err := config.LoadBilling(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
 	// Настраиваем логгер
 	logger := logrus.New()
-	logger.SetLevel(logrus.InfoLevel)
+	logger.SetLevel(cfg.Level())
 	logger.SetFormatter(&logrus.JSONFormatter{})
 
 	// Подключаемся к PostgreSQL
-	db, err := sql.Open("postgres", "host=localhost port=5432 user=postgres password=password dbname=insurance sslmode=disable")
+	db, err := sql.Open("postgres", cfg.Database.DSN())
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
@@ -32,40 +45,68 @@ func main() {
 		log.Fatalf("Failed to ping database: %v", err)
 	}
 
-	// Конфигурация Kafka
-	config := kafka.DefaultConfig()
-	config.GroupID = "billing-service"
-	config.Topic = "auto.events"
-	config.DLQTopic = "auto.events.dlq"
+	// Метрики сервиса в собственном реестре, его же отдаёт служебный сервер
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	cfg.Kafka.Registerer = registry
 
 	// Создаём handler для billing
-	handler := billing.NewHandler(db, logger)
+	handler := billing.NewHandler(db, registry, logger)
 
 	// Создаём consumer
-	consumer, err := kafka.NewConsumer(config, handler, db, logger)
+	consumer, err := kafka.NewConsumer(cfg.Kafka, handler, db, logger)
 	if err != nil {
 		log.Fatalf("Failed to create consumer: %v", err)
 	}
 
-	// Контекст для graceful shutdown
+	// Повторно доставленные события не должны выставлять счёт дважды
+	consumer.Use(kafka.NewDedupMiddleware(db, cfg.Kafka.GroupID, cfg.Kafka.DedupRetention, registry, logger))
+
+	// Контекст служебного сервера
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Обработка сигналов для graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
+	// Метрики и health-пробы, Prometheus собирает метрики с admin_addr (по умолчанию :8082)
+	admin := kafka.NewAdminServer(cfg.AdminAddr, consumer, registry, cfg.AdminToken, logger)
 	go func() {
-		<-sigChan
-		logger.Info("Received shutdown signal, stopping consumer...")
-		cancel()
+		if err := admin.Run(ctx); err != nil {
+			log.Fatalf("Admin server error: %v", err)
+		}
 	}()
 
 	logger.Info("Starting Billing consumer service...")
 
 	// Запускаем consumer
-	if err := consumer.Start(ctx); err != nil {
-		log.Fatalf("Consumer error: %v", err)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- consumer.Start(ctx)
+	}()
+
+	// Обработка сигналов для graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			log.Fatalf("Consumer error: %v", err)
+		}
+		// Start вернул nil: консьюмер уже остановлен, Shutdown только закроет продюсеры
+		logger.Info("Consumer stopped, shutting down...")
+		errs <- nil
+	case <-sigChan:
+		logger.Info("Received shutdown signal, draining consumer...")
+	}
+
+	// Дожидаемся обрабатываемых сообщений и коммитим offset'ы
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.Kafka.ShutdownTimeout)
+	defer cancelShutdown()
+
+	if err := consumer.Shutdown(shutdownCtx); err != nil {
+		logger.WithError(err).Error("Consumer shutdown failed")
+	}
+	if err := <-errs; err != nil {
+		logger.WithError(err).Error("Consumer stopped with error")
 	}
 
 	logger.Info("Billing consumer service stopped")
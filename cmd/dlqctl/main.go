@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/gobulgur/kafka-serves/pkg/config"
+	"github.com/gobulgur/kafka-serves/pkg/kafka"
+)
+
+const usage = `dlqctl - просмотр и переотправка сообщений из Dead Letter Queue
+
+Использование:
+  dlqctl list   [флаги]   список записей DLQ
+  dlqctl dump   [флаги]   записи DLQ в JSON, по одной на строку
+  dlqctl replay [флаги]   переотправка записей консьюмер-группе, которая их не обработала
+                          (через первый уровень повторов), с -all-groups - в исходный топик
+
+Флаги:
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command := os.Args[1]
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "путь к YAML-файлу конфигурации: брокеры, TLS и SASL")
+	brokers := flags.String("brokers", "", "адреса брокеров Kafka через запятую, по умолчанию из конфигурации")
+	topic := flags.String("topic", "", "топик DLQ, по умолчанию из конфигурации или auto.events.dlq")
+	errorContains := flags.String("error", "", "отбирать записи, текст ошибки которых содержит строку")
+	eventType := flags.String("event-type", "", "отбирать записи по типу события")
+	policyID := flags.String("policy-id", "", "отбирать записи по policy_id")
+	since := flags.String("since", "", "отбирать записи не раньше времени (RFC 3339)")
+	until := flags.String("until", "", "отбирать записи не позже времени (RFC 3339)")
+	positions := flags.String("positions", "", "отбирать записи по позициям в DLQ: partition:offset через запятую")
+	patchFile := flags.String("patch", "", "replay: JSON Merge Patch, который применяется к payload перед отправкой")
+	all := flags.Bool("all", false, "replay: разрешить переотправку без фильтров")
+	allGroups := flags.Bool("all-groups", false, "replay: отправить в исходный топик, запись обработают все консьюмер-группы")
+	dryRun := flags.Bool("dry-run", false, "replay: показать, что будет отправлено, без отправки")
+	timeout := flags.Duration("timeout", time.Minute, "максимальное время чтения DLQ")
+
+	if err := flags.Parse(os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
+
+	// Брокеры, TLS и SASL берутся из конфигурации сервисов, флаги имеют приоритет
+	cfg, err := config.LoadKafka(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if *brokers != "" {
+		cfg.Brokers = strings.Split(*brokers, ",")
+	}
+	if *topic == "" {
+		*topic = cfg.DLQTopic
+	}
+	if *topic == "" {
+		*topic = "auto.events.dlq"
+	}
+
+	filter := &kafka.DLQFilter{
+		ErrorContains: *errorContains,
+		EventType:     *eventType,
+		PolicyID:      *policyID,
+		Since:         parseTime("since", *since),
+		Until:         parseTime("until", *until),
+	}
+	selected := parsePositions(*positions)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	entries, err := kafka.ReadDLQFromConfig(ctx, cfg, *topic)
+	if err != nil {
+		log.Fatalf("Failed to read DLQ: %v", err)
+	}
+
+	var matched []*kafka.DLQEntry
+	for _, entry := range entries {
+		if !filter.Match(entry) {
+			continue
+		}
+		if selected != nil && !selected[positionKey(entry.Partition, entry.Offset)] {
+			continue
+		}
+		matched = append(matched, entry)
+	}
+
+	switch command {
+	case "list":
+		list(matched)
+	case "dump":
+		dump(matched)
+	case "replay":
+		filtered := *filter != (kafka.DLQFilter{}) || selected != nil
+		if !filtered && !*all {
+			log.Fatal("Refusing to replay the whole DLQ without filters, pass -all to confirm")
+		}
+
+		var patch []byte
+		if *patchFile != "" {
+			patch, err = os.ReadFile(*patchFile)
+			if err != nil {
+				log.Fatalf("Failed to read patch: %v", err)
+			}
+		}
+		replay(cfg, matched, patch, *allGroups, *dryRun)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
+
+// list печатает записи DLQ таблицей
+func list(entries []*kafka.DLQEntry) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "POSITION\tTIME\tORIGINAL\tEVENT TYPE\tPOLICY ID\tERROR")
+
+	for _, entry := range entries {
+		eventType, policyID := "-", "-"
+		if entry.Event != nil {
+			eventType, policyID = entry.Event.EventType, entry.Event.PolicyID
+		}
+
+		fmt.Fprintf(writer, "%d:%d\t%s\t%s/%d/%d\t%s\t%s\t%s\n",
+			entry.Partition, entry.Offset,
+			entry.Message.Timestamp.Format(time.RFC3339),
+			entry.Message.OriginalTopic, entry.Message.OriginalPartition, entry.Message.OriginalOffset,
+			eventType, policyID,
+			entry.Message.Error,
+		)
+	}
+
+	writer.Flush()
+	fmt.Fprintf(os.Stderr, "%d entries\n", len(entries))
+}
+
+// dump печатает записи DLQ в JSON Lines
+func dump(entries []*kafka.DLQEntry) {
+	encoder := json.NewEncoder(os.Stdout)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			log.Fatalf("Failed to encode entry %s: %v", entry.Position(), err)
+		}
+	}
+}
+
+// replay переотправляет записи DLQ, применяя patch к payload. По умолчанию запись уходит
+// в первый уровень повторов исходного топика и её обрабатывает только группа из записи,
+// с allGroups - в исходный топик.
+func replay(cfg *kafka.Config, entries []*kafka.DLQEntry, patch []byte, allGroups, dryRun bool) {
+	var producer sarama.SyncProducer
+	if !dryRun {
+		producerConfig, err := cfg.ProducerConfig()
+		if err != nil {
+			log.Fatalf("Failed to configure producer: %v", err)
+		}
+		producer, err = sarama.NewSyncProducer(cfg.Brokers, producerConfig)
+		if err != nil {
+			log.Fatalf("Failed to create producer: %v", err)
+		}
+		defer producer.Close()
+	}
+
+	for _, entry := range entries {
+		payload := entry.Payload()
+		if patch != nil {
+			patched, err := kafka.MergePatch(payload, patch)
+			if err != nil {
+				log.Fatalf("Failed to patch entry %s: %v", entry.Position(), err)
+			}
+			payload = patched
+		}
+
+		target, retryTopic := entry.Message.OriginalTopic, ""
+		if !allGroups {
+			if entry.Message.ConsumerGroup == "" {
+				log.Fatalf("Entry %s has no consumer group, pass -all-groups to replay it to every group", entry.Position())
+			}
+			retryTopic = replayTopic(cfg, entry.Message.OriginalTopic)
+			target = fmt.Sprintf("%s (group %s)", retryTopic, entry.Message.ConsumerGroup)
+		}
+
+		if dryRun {
+			fmt.Printf("%s -> %s: %s\n", entry.Position(), target, payload)
+			continue
+		}
+
+		result, err := kafka.ReplayDLQEntry(producer, entry, payload, retryTopic)
+		if err != nil {
+			log.Fatalf("Failed to replay: %v", err)
+		}
+		fmt.Printf("%s -> %s/%d/%d\n", entry.Position(), result.Topic, result.Partition, result.Offset)
+	}
+
+	fmt.Fprintf(os.Stderr, "%d entries replayed\n", len(entries))
+}
+
+// replayTopic возвращает первый уровень повторов исходного топика: из конфигурации,
+// а если уровни в ней не заданы - по умолчанию, см. kafka.DefaultRetryTiers
+func replayTopic(cfg *kafka.Config, originalTopic string) string {
+	if len(cfg.RetryTiers) > 0 {
+		return cfg.RetryTiers[0].Topic
+	}
+	return kafka.DefaultRetryTiers(originalTopic)[0].Topic
+}
+
+// parseTime разбирает время в формате RFC 3339, пустая строка - нулевое время
+func parseTime(name, value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Fatalf("Invalid -%s: %v", name, err)
+	}
+	return t
+}
+
+// parsePositions разбирает список partition:offset, пустая строка - без отбора
+func parsePositions(value string) map[string]bool {
+	if value == "" {
+		return nil
+	}
+
+	positions := make(map[string]bool)
+	for _, position := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(position), ":")
+		if len(parts) != 2 {
+			log.Fatalf("Invalid position %q, expected partition:offset", position)
+		}
+
+		partition, err := strconv.ParseInt(parts[0], 10, 32)
+		if err != nil {
+			log.Fatalf("Invalid partition in %q: %v", position, err)
+		}
+		offset, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid offset in %q: %v", position, err)
+		}
+		positions[positionKey(int32(partition), offset)] = true
+	}
+	return positions
+}
+
+// positionKey возвращает ключ позиции записи в DLQ
+func positionKey(partition int32, offset int64) string {
+	return fmt.Sprintf("%d:%d", partition, offset)
+}
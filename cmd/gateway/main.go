@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
+	"flag"
 	"log"
 	"net/http"
 	"os"
@@ -15,18 +16,28 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 
+	"github.com/gobulgur/kafka-serves/pkg/config"
 	"github.com/gobulgur/kafka-serves/pkg/kafka"
 	"github.com/gobulgur/kafka-serves/services/gateway"
 )
 
 func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "путь к YAML-файлу конфигурации")
+	flag.Parse()
+
+	// Загружаем конфигурацию: YAML-файл, поверх него переменные окружения
+	cfg, err := config.LoadGateway(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
 	// Настраиваем логгер
 	logger := logrus.New()
-	logger.SetLevel(logrus.InfoLevel)
+	logger.SetLevel(cfg.Level())
 	logger.SetFormatter(&logrus.JSONFormatter{})
 
 	// Подключаемся к PostgreSQL
-	db, err := sql.Open("postgres", "host=localhost port=5432 user=postgres password=password dbname=insurance sslmode=disable")
+	db, err := sql.Open("postgres", cfg.Database.DSN())
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
@@ -37,13 +48,22 @@ func main() {
 	}
 
 	// Создаём Kafka продюсер
-	brokers := []string{"localhost:9092", "localhost:9093", "localhost:9094"}
-	producer, err := kafka.NewProducer(brokers, db, logger)
+	producer, err := kafka.NewProducerFromConfig(cfg.Kafka, db, logger)
 	if err != nil {
 		log.Fatalf("Failed to create producer: %v", err)
 	}
 	defer producer.Close()
 
+	// Ретранслятор outbox досылает события, которые не удалось опубликовать сразу
+	relay := kafka.NewOutboxRelay(producer, db, logger)
+
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		relay.Run(relayCtx)
+	}()
+
 	// Создаём gateway сервис
 	gatewayService := gateway.NewService(producer, logger)
 
@@ -82,13 +102,13 @@ func main() {
 
 	// Настраиваем HTTP сервер
 	srv := &http.Server{
-		Addr:    ":8080",
+		Addr:    cfg.Addr,
 		Handler: router,
 	}
 
 	// Запускаем сервер в горутине
 	go func() {
-		logger.Info("Starting Gateway service on :8080")
+		logger.WithField("addr", cfg.Addr).Info("Starting Gateway service")
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Failed to start server: %v", err)
 		}
@@ -109,5 +129,9 @@ func main() {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 
+	// Неотправленные события остаются в outbox и будут опубликованы после рестарта
+	stopRelay()
+	<-relayDone
+
 	logger.Info("Gateway service stopped")
 }
@@ -0,0 +1,328 @@
+// Package config загружает конфигурацию сервисов из YAML-файла и переменных окружения.
+// Переменные окружения имеют приоритет над файлом, файл - над значениями по умолчанию.
+// Пустая переменная окружения считается незаданной.
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/gobulgur/kafka-serves/pkg/kafka"
+)
+
+// Database содержит настройки подключения к PostgreSQL
+type Database struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Name     string `yaml:"name"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	SSLMode  string `yaml:"sslmode"`
+}
+
+// DSN возвращает строку подключения для lib/pq
+func (d *Database) DSN() string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		dsnValue(d.Host), d.Port, dsnValue(d.User), dsnValue(d.Password), dsnValue(d.Name), dsnValue(d.SSLMode))
+}
+
+// Validate проверяет обязательные настройки базы данных
+func (d *Database) Validate() error {
+	switch {
+	case d.Host == "":
+		return fmt.Errorf("database host is required")
+	case d.Port <= 0:
+		return fmt.Errorf("database port must be positive")
+	case d.Name == "":
+		return fmt.Errorf("database name is required")
+	case d.User == "":
+		return fmt.Errorf("database user is required")
+	}
+	return nil
+}
+
+// Common содержит настройки, общие для всех сервисов
+type Common struct {
+	LogLevel string        `yaml:"log_level"`
+	Database Database      `yaml:"database"`
+	Kafka    *kafka.Config `yaml:"kafka"`
+}
+
+// Level возвращает уровень логирования. Конфигурация должна быть проверена Validate.
+func (c *Common) Level() logrus.Level {
+	level, err := logrus.ParseLevel(c.LogLevel)
+	if err != nil {
+		return logrus.InfoLevel
+	}
+	return level
+}
+
+// Validate проверяет общие настройки
+func (c *Common) Validate() error {
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("invalid log level: %w", err)
+	}
+	if err := c.Database.Validate(); err != nil {
+		return err
+	}
+	return c.Kafka.Validate()
+}
+
+// Gateway — конфигурация HTTP gateway
+type Gateway struct {
+	Common `yaml:",inline"`
+	// Addr — адрес HTTP API
+	Addr string `yaml:"addr"`
+}
+
+// Consumer — конфигурация консьюмер-сервиса (underwriting, billing)
+type Consumer struct {
+	Common `yaml:",inline"`
+	// AdminAddr — адрес служебного сервера с метриками и пробами
+	AdminAddr string `yaml:"admin_addr"`
+	// AdminToken — токен для /pause и /resume служебного сервера, пусто - endpoint'ы отключены
+	AdminToken string `yaml:"admin_token"`
+}
+
+// Validate проверяет настройки консьюмер-сервиса
+func (c *Consumer) Validate() error {
+	if err := c.Common.Validate(); err != nil {
+		return err
+	}
+	if c.Kafka.GroupID == "" {
+		return fmt.Errorf("kafka group_id is required")
+	}
+	if c.Kafka.Topic == "" {
+		return fmt.Errorf("kafka topic is required")
+	}
+	if c.AdminAddr == "" {
+		return fmt.Errorf("admin_addr is required")
+	}
+	return nil
+}
+
+// LoadGateway загружает конфигурацию gateway. path - YAML-файл, пустая строка - без файла.
+func LoadGateway(path string) (*Gateway, error) {
+	cfg := &Gateway{
+		Common: defaultCommon(),
+		Addr:   ":8080",
+	}
+
+	if err := loadFile(path, cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.overlayEnv(); err != nil {
+		return nil, err
+	}
+	if port := os.Getenv("GATEWAY_PORT"); port != "" {
+		cfg.Addr = ":" + port
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid gateway config: %w", err)
+	}
+	return cfg, nil
+}
+
+// LoadUnderwriting загружает конфигурацию underwriting
+func LoadUnderwriting(path string) (*Consumer, error) {
+	cfg := defaultConsumer(":8081")
+	cfg.Kafka.GroupID = "underwriting-service"
+	// Offset'ы сохраняются в PostgreSQL в одной транзакции с результатами обработки
+	cfg.Kafka.OffsetStore = true
+	// События premium_calculated публикуются в одной транзакции с offset'ом auto.events
+	cfg.Kafka.Transactional = true
+
+	return loadConsumer(path, "UNDERWRITING", cfg)
+}
+
+// LoadBilling загружает конфигурацию billing
+func LoadBilling(path string) (*Consumer, error) {
+	cfg := defaultConsumer(":8082")
+	cfg.Kafka.GroupID = "billing-service"
+	// Offset'ы сохраняются в PostgreSQL в одной транзакции с результатами обработки
+	cfg.Kafka.OffsetStore = true
+	// В пики продлений (конец месяца) счета пишутся пакетами, см. billing.Handler.HandleBatch
+	cfg.Kafka.BatchSize = 200
+
+	return loadConsumer(path, "BILLING", cfg)
+}
+
+// LoadKafka загружает только секцию kafka конфигурации, для утилит без базы данных
+func LoadKafka(path string) (*kafka.Config, error) {
+	cfg := struct {
+		Kafka *kafka.Config `yaml:"kafka"`
+	}{Kafka: kafka.DefaultConfig()}
+
+	if err := loadFile(path, &cfg); err != nil {
+		return nil, err
+	}
+	if err := overlayKafkaEnv(cfg.Kafka); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Kafka.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid kafka config: %w", err)
+	}
+	return cfg.Kafka, nil
+}
+
+// defaultCommon возвращает общие настройки локального окружения без пароля базы
+func defaultCommon() Common {
+	return Common{
+		LogLevel: "info",
+		Database: Database{
+			Host:    "localhost",
+			Port:    5432,
+			Name:    "insurance",
+			User:    "postgres",
+			SSLMode: "disable",
+		},
+		Kafka: kafka.DefaultConfig(),
+	}
+}
+
+// defaultConsumer возвращает настройки консьюмер-сервиса, читающего auto.events
+func defaultConsumer(adminAddr string) *Consumer {
+	cfg := &Consumer{
+		Common:    defaultCommon(),
+		AdminAddr: adminAddr,
+	}
+	cfg.Kafka.Topic = "auto.events"
+	cfg.Kafka.DLQTopic = "auto.events.dlq"
+	return cfg
+}
+
+// loadConsumer загружает конфигурацию консьюмер-сервиса поверх значений по умолчанию.
+// prefix - префикс переменных окружения сервиса, например BILLING.
+func loadConsumer(path, prefix string, cfg *Consumer) (*Consumer, error) {
+	if err := loadFile(path, cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.overlayEnv(); err != nil {
+		return nil, err
+	}
+	envString(prefix+"_GROUP_ID", &cfg.Kafka.GroupID)
+	if port := os.Getenv(prefix + "_ADMIN_PORT"); port != "" {
+		cfg.AdminAddr = ":" + port
+	}
+	envString(prefix+"_ADMIN_TOKEN", &cfg.AdminToken)
+
+	// Неудачные сообщения повторяются через топики <topic>.retry.*, не блокируя партицию.
+	// Пустой список retry_tiers в файле отключает уровни повторов.
+	if cfg.Kafka.RetryTiers == nil {
+		cfg.Kafka.RetryTiers = kafka.DefaultRetryTiers(cfg.Kafka.Topic)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s config: %w", strings.ToLower(prefix), err)
+	}
+	return cfg, nil
+}
+
+// loadFile читает YAML-файл поверх уже заполненной конфигурации
+func loadFile(path string, cfg interface{}) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// overlayEnv применяет общие переменные окружения
+func (c *Common) overlayEnv() error {
+	envString("LOG_LEVEL", &c.LogLevel)
+
+	envString("POSTGRES_HOST", &c.Database.Host)
+	if err := envInt("POSTGRES_PORT", &c.Database.Port); err != nil {
+		return err
+	}
+	envString("POSTGRES_DB", &c.Database.Name)
+	envString("POSTGRES_USER", &c.Database.User)
+	envString("POSTGRES_PASSWORD", &c.Database.Password)
+	envString("POSTGRES_SSLMODE", &c.Database.SSLMode)
+
+	return overlayKafkaEnv(c.Kafka)
+}
+
+// overlayKafkaEnv применяет переменные окружения Kafka
+func overlayKafkaEnv(cfg *kafka.Config) error {
+	if brokers := os.Getenv("KAFKA_BROKERS"); brokers != "" {
+		cfg.Brokers = strings.Split(brokers, ",")
+	}
+	envString("KAFKA_TOPIC", &cfg.Topic)
+	envString("KAFKA_DLQ_TOPIC", &cfg.DLQTopic)
+	envString("KAFKA_VERSION", &cfg.Version)
+
+	if err := envBool("KAFKA_TLS_ENABLED", &cfg.TLS.Enabled); err != nil {
+		return err
+	}
+	envString("KAFKA_TLS_CA_FILE", &cfg.TLS.CAFile)
+	envString("KAFKA_TLS_CERT_FILE", &cfg.TLS.CertFile)
+	envString("KAFKA_TLS_KEY_FILE", &cfg.TLS.KeyFile)
+	envString("KAFKA_TLS_SERVER_NAME", &cfg.TLS.ServerName)
+
+	envString("KAFKA_SASL_MECHANISM", &cfg.SASL.Mechanism)
+	envString("KAFKA_SASL_USERNAME", &cfg.SASL.Username)
+	envString("KAFKA_SASL_PASSWORD", &cfg.SASL.Password)
+	envString("KAFKA_SASL_PASSWORD_FILE", &cfg.SASL.PasswordFile)
+	return nil
+}
+
+// envString заменяет значение переменной окружения, если она задана. Пустая переменная
+// считается незаданной: шаблоны окружения вида KAFKA_TLS_CA_FILE= не затирают файл.
+func envString(key string, value *string) {
+	if env := os.Getenv(key); env != "" {
+		*value = env
+	}
+}
+
+// envInt заменяет значение числом из переменной окружения, если она задана и не пуста
+func envInt(key string, value *int) error {
+	env := os.Getenv(key)
+	if env == "" {
+		return nil
+	}
+	parsed, err := strconv.Atoi(env)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	*value = parsed
+	return nil
+}
+
+// envBool заменяет значение флагом из переменной окружения, если она задана и не пуста
+func envBool(key string, value *bool) error {
+	env := os.Getenv(key)
+	if env == "" {
+		return nil
+	}
+	parsed, err := strconv.ParseBool(env)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	*value = parsed
+	return nil
+}
+
+// dsnValue экранирует значение для строки подключения key=value
+func dsnValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
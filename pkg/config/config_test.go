@@ -0,0 +1,214 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// envKeys — переменные окружения, которые читает LoadBilling
+var envKeys = []string{
+	"LOG_LEVEL",
+	"POSTGRES_HOST", "POSTGRES_PORT", "POSTGRES_DB", "POSTGRES_USER", "POSTGRES_PASSWORD", "POSTGRES_SSLMODE",
+	"KAFKA_BROKERS", "KAFKA_TOPIC", "KAFKA_DLQ_TOPIC", "KAFKA_VERSION",
+	"KAFKA_TLS_ENABLED", "KAFKA_TLS_CA_FILE", "KAFKA_TLS_CERT_FILE", "KAFKA_TLS_KEY_FILE", "KAFKA_TLS_SERVER_NAME",
+	"KAFKA_SASL_MECHANISM", "KAFKA_SASL_USERNAME", "KAFKA_SASL_PASSWORD", "KAFKA_SASL_PASSWORD_FILE",
+	"BILLING_GROUP_ID", "BILLING_ADMIN_PORT", "BILLING_ADMIN_TOKEN",
+}
+
+// clearEnv сбрасывает переменные окружения конфигурации на время теста
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, key := range envKeys {
+		t.Setenv(key, "")
+	}
+}
+
+// writeConfig записывает YAML-файл конфигурации и возвращает путь, пустой content - без файла
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	if content == "" {
+		return ""
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadBillingPrecedence(t *testing.T) {
+	const file = `
+log_level: debug
+admin_addr: ":9100"
+database:
+  host: file-db
+  port: 6432
+kafka:
+  group_id: file-group
+  topic: file.events
+  sasl:
+    mechanism: PLAIN
+    username: file-user
+    password: file-secret
+`
+
+	type values struct {
+		logLevel     string
+		dbHost       string
+		dbPort       int
+		groupID      string
+		topic        string
+		adminAddr    string
+		saslMech     string
+		saslUsername string
+	}
+
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		want values
+	}{
+		{
+			name: "defaults",
+			want: values{
+				logLevel:  "info",
+				dbHost:    "localhost",
+				dbPort:    5432,
+				groupID:   "billing-service",
+				topic:     "auto.events",
+				adminAddr: ":8082",
+			},
+		},
+		{
+			name: "file overrides defaults",
+			file: file,
+			want: values{
+				logLevel:     "debug",
+				dbHost:       "file-db",
+				dbPort:       6432,
+				groupID:      "file-group",
+				topic:        "file.events",
+				adminAddr:    ":9100",
+				saslMech:     "PLAIN",
+				saslUsername: "file-user",
+			},
+		},
+		{
+			name: "env overrides file",
+			file: file,
+			env: map[string]string{
+				"LOG_LEVEL":            "warn",
+				"POSTGRES_HOST":        "env-db",
+				"POSTGRES_PORT":        "7432",
+				"BILLING_GROUP_ID":     "env-group",
+				"KAFKA_TOPIC":          "env.events",
+				"BILLING_ADMIN_PORT":   "9200",
+				"KAFKA_SASL_USERNAME":  "env-user",
+				"KAFKA_SASL_MECHANISM": "SCRAM-SHA-512",
+			},
+			want: values{
+				logLevel:     "warn",
+				dbHost:       "env-db",
+				dbPort:       7432,
+				groupID:      "env-group",
+				topic:        "env.events",
+				adminAddr:    ":9200",
+				saslMech:     "SCRAM-SHA-512",
+				saslUsername: "env-user",
+			},
+		},
+		{
+			name: "env overrides defaults without file",
+			env: map[string]string{
+				"POSTGRES_HOST":    "env-db",
+				"BILLING_GROUP_ID": "env-group",
+			},
+			want: values{
+				logLevel:  "info",
+				dbHost:    "env-db",
+				dbPort:    5432,
+				groupID:   "env-group",
+				topic:     "auto.events",
+				adminAddr: ":8082",
+			},
+		},
+		{
+			name: "empty env keeps file",
+			file: file,
+			env: map[string]string{
+				"LOG_LEVEL":            "",
+				"POSTGRES_HOST":        "",
+				"POSTGRES_PORT":        "",
+				"BILLING_GROUP_ID":     "",
+				"KAFKA_TOPIC":          "",
+				"BILLING_ADMIN_PORT":   "",
+				"KAFKA_SASL_MECHANISM": "",
+				"KAFKA_SASL_USERNAME":  "",
+				"KAFKA_TLS_ENABLED":    "",
+			},
+			want: values{
+				logLevel:     "debug",
+				dbHost:       "file-db",
+				dbPort:       6432,
+				groupID:      "file-group",
+				topic:        "file.events",
+				adminAddr:    ":9100",
+				saslMech:     "PLAIN",
+				saslUsername: "file-user",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, err := LoadBilling(writeConfig(t, tt.file))
+			if err != nil {
+				t.Fatalf("LoadBilling: %v", err)
+			}
+
+			got := values{
+				logLevel:     cfg.LogLevel,
+				dbHost:       cfg.Database.Host,
+				dbPort:       cfg.Database.Port,
+				groupID:      cfg.Kafka.GroupID,
+				topic:        cfg.Kafka.Topic,
+				adminAddr:    cfg.AdminAddr,
+				saslMech:     cfg.Kafka.SASL.Mechanism,
+				saslUsername: cfg.Kafka.SASL.Username,
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadBillingInvalidEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		env  string
+	}{
+		{name: "port is not a number", key: "POSTGRES_PORT", env: "postgres"},
+		{name: "tls flag is not a bool", key: "KAFKA_TLS_ENABLED", env: "maybe"},
+		{name: "unknown log level", key: "LOG_LEVEL", env: "loud"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			t.Setenv(tt.key, tt.env)
+
+			if _, err := LoadBilling(""); err == nil {
+				t.Errorf("LoadBilling with %s=%q: expected error", tt.key, tt.env)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package kafka
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// adminShutdownTimeout — сколько AdminServer ждёт завершения запросов при остановке
+const adminShutdownTimeout = time.Second * 5
+
+// AdminServer — служебный HTTP-сервер консьюмер-сервиса:
+//   - /metrics - метрики Prometheus
+//   - /healthz - liveness, процесс жив
+//   - /readyz  - readiness, сессия консьюмер-группы активна и партиции назначены
+//   - /pause, /resume - POST приостанавливает и возобновляет консьюмер, GET - состояние.
+//     Требуют заголовок Authorization: Bearer <controlToken>.
+type AdminServer struct {
+	server       *http.Server
+	consumer     *Consumer
+	controlToken string
+	logger       *logrus.Logger
+}
+
+// NewAdminServer создаёт служебный сервер на addr. gatherer - источник метрик,
+// nil - prometheus.DefaultGatherer. controlToken защищает /pause и /resume,
+// пустая строка отключает их: порт метрик обычно доступен всем в кластере.
+func NewAdminServer(addr string, consumer *Consumer, gatherer prometheus.Gatherer, controlToken string, logger *logrus.Logger) *AdminServer {
+	if gatherer == nil {
+		gatherer = prometheus.DefaultGatherer
+	}
+
+	s := &AdminServer{
+		consumer:     consumer,
+		controlToken: controlToken,
+		logger:       logger,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/readyz", s.handleReady)
+	mux.HandleFunc("/pause", s.handlePause)
+	mux.HandleFunc("/resume", s.handleResume)
+
+	s.server = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 5,
+	}
+	return s
+}
+
+// Run обслуживает запросы, пока не отменён ctx
+func (s *AdminServer) Run(ctx context.Context) error {
+	errs := make(chan error, 1)
+	go func() {
+		s.logger.WithField("addr", s.server.Addr).Info("Starting admin server")
+		errs <- s.server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return fmt.Errorf("admin server failed: %w", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+
+	if err := s.server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to shut down admin server: %w", err)
+	}
+	return nil
+}
+
+// handleHealth отвечает на liveness-пробу
+func (s *AdminServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+// handleReady отвечает на readiness-пробу
+func (s *AdminServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	partitions := s.consumer.AssignedPartitions()
+	if partitions == 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"status":     "not ready",
+			"partitions": partitions,
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     "ready",
+		"partitions": partitions,
+		"paused":     s.consumer.PauseReasons(),
+	})
+}
+
+// handlePause приостанавливает консьюмер
+func (s *AdminServer) handlePause(w http.ResponseWriter, r *http.Request) {
+	s.handlePauseState(w, r, s.consumer.Pause)
+}
+
+// handleResume снимает ручную приостановку консьюмера
+func (s *AdminServer) handleResume(w http.ResponseWriter, r *http.Request) {
+	s.handlePauseState(w, r, s.consumer.Resume)
+}
+
+// handlePauseState на POST вызывает change, на GET только возвращает состояние
+func (s *AdminServer) handlePauseState(w http.ResponseWriter, r *http.Request, change func()) {
+	if !s.authorize(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		change()
+	case http.MethodGet:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": "method not allowed"})
+		return
+	}
+
+	reasons := s.consumer.PauseReasons()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"paused":  len(reasons) > 0,
+		"reasons": reasons,
+	})
+}
+
+// authorize проверяет токен управления консьюмером. Если токен не задан в конфигурации
+// или не совпадает, пишет ответ с ошибкой и возвращает false.
+func (s *AdminServer) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if s.controlToken == "" {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "consumer control is disabled"})
+		return false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.controlToken)) != 1 {
+		s.logger.WithField("remote_addr", r.RemoteAddr).Warn("Unauthorized consumer control request")
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": "unauthorized"})
+		return false
+	}
+	return true
+}
+
+// writeJSON пишет ответ в JSON
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
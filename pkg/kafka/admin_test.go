@@ -0,0 +1,86 @@
+package kafka
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestAdminServer создаёт AdminServer для консьюмера без подключения к Kafka
+func newTestAdminServer(t *testing.T, controlToken string) (*AdminServer, *Consumer) {
+	t.Helper()
+	metrics, logger := newTestMetrics(t)
+	consumer := &Consumer{
+		config:  &Config{GroupID: "billing-service"},
+		logger:  logger,
+		metrics: metrics,
+		pauses:  newPauseState(),
+	}
+	return NewAdminServer(":0", consumer, nil, controlToken, logger), consumer
+}
+
+func TestAdminServerControlAuth(t *testing.T) {
+	const token = "secret"
+
+	tests := []struct {
+		name          string
+		controlToken  string
+		method        string
+		path          string
+		authorization string
+		pausedBefore  bool
+		wantStatus    int
+		wantPaused    bool
+	}{
+		{name: "control disabled", method: http.MethodPost, path: "/pause", authorization: "Bearer ", wantStatus: http.StatusNotFound},
+		{name: "missing token", controlToken: token, method: http.MethodPost, path: "/pause", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", controlToken: token, method: http.MethodPost, path: "/pause", authorization: "Bearer other", wantStatus: http.StatusUnauthorized},
+		{name: "token without bearer scheme", controlToken: token, method: http.MethodPost, path: "/pause", authorization: token, wantStatus: http.StatusUnauthorized},
+		{name: "state requires token", controlToken: token, method: http.MethodGet, path: "/pause", wantStatus: http.StatusUnauthorized},
+		{name: "pause", controlToken: token, method: http.MethodPost, path: "/pause", authorization: "Bearer " + token, wantStatus: http.StatusOK, wantPaused: true},
+		{name: "resume", controlToken: token, method: http.MethodPost, path: "/resume", authorization: "Bearer " + token, pausedBefore: true, wantStatus: http.StatusOK},
+		{name: "get state", controlToken: token, method: http.MethodGet, path: "/resume", authorization: "Bearer " + token, pausedBefore: true, wantStatus: http.StatusOK, wantPaused: true},
+		{name: "unsupported method", controlToken: token, method: http.MethodPut, path: "/pause", authorization: "Bearer " + token, wantStatus: http.StatusMethodNotAllowed},
+		{name: "unauthorized resume keeps pause", controlToken: token, method: http.MethodPost, path: "/resume", authorization: "Bearer other", pausedBefore: true, wantStatus: http.StatusUnauthorized, wantPaused: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, consumer := newTestAdminServer(t, tt.controlToken)
+			if tt.pausedBefore {
+				consumer.Pause()
+			}
+
+			request := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.authorization != "" {
+				request.Header.Set("Authorization", tt.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			server.server.Handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("%s %s status = %d, want %d", tt.method, tt.path, recorder.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want Bearer", recorder.Header().Get("WWW-Authenticate"))
+			}
+			if got := len(consumer.PauseReasons()) > 0; got != tt.wantPaused {
+				t.Errorf("consumer paused = %v, want %v", got, tt.wantPaused)
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var body struct {
+				Paused bool `json:"paused"`
+			}
+			if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if body.Paused != tt.wantPaused {
+				t.Errorf("response paused = %v, want %v", body.Paused, tt.wantPaused)
+			}
+		})
+	}
+}
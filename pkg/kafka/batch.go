@@ -0,0 +1,218 @@
+package kafka
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+)
+
+// BatchHandler — необязательный интерфейс обработчика подписки для пакетной обработки.
+// Если обработчик его реализует и Config.BatchSize больше 1, сообщения партиции
+// передаются ему пакетами, а offset коммитится один раз на пакет. Если у консьюмера есть
+// база данных, пакет обрабатывается в одной транзакции, см. TxFromContext.
+type BatchHandler interface {
+	HandleBatch(ctx context.Context, messages []*sarama.ConsumerMessage) error
+}
+
+// BatchMiddleware — middleware, которое умеет обрабатывать пакет целиком. Middleware
+// без ProcessBatch к пакету не применяются, только к сообщениям при обработке по одному.
+// В том числе RetryMiddleware: неудачный пакет не повторяется целиком, а обрабатывается
+// по одному сообщению, и повторы по RetryPolicy применяются к каждому из них.
+type BatchMiddleware interface {
+	ProcessBatch(ctx context.Context, messages []*sarama.ConsumerMessage, next func(context.Context, []*sarama.ConsumerMessage) error) error
+}
+
+// batchHandler возвращает подписку и пакетный обработчик для партиции топика или nil,
+// если партиция обрабатывается по одному сообщению. Топики повторов всегда
+// обрабатываются по одному: их сообщения ждут своей задержки.
+func (c *Consumer) batchHandler(topic string) (*subscription, BatchHandler) {
+	if c.config.BatchSize <= 1 || c.retryTierIndex(topic) >= 0 {
+		return nil, nil
+	}
+
+	sub := c.subscriptionFor(topic)
+	if sub == nil {
+		return nil, nil
+	}
+
+	handler, ok := sub.handler.(BatchHandler)
+	if !ok {
+		return nil, nil
+	}
+	return sub, handler
+}
+
+// consumeBatches читает партицию пакетами до Config.BatchSize сообщений. Неполный
+// пакет обрабатывается через Config.BatchMaxWait после его первого сообщения.
+func (c *Consumer) consumeBatches(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim, sub *subscription, handler BatchHandler, drained func()) error {
+	batch := make([]*sarama.ConsumerMessage, 0, c.config.BatchSize)
+	timer := time.NewTimer(c.config.BatchMaxWait)
+	stopTimer(timer)
+	defer timer.Stop()
+
+	for {
+		select {
+		case message := <-claim.Messages():
+			if message == nil {
+				// Незавершённый пакет не коммитился и будет прочитан заново
+				return nil
+			}
+			c.lag.observe(message.Topic, message.Partition, claim.HighWaterMarkOffset())
+
+			batch = append(batch, message)
+			if len(batch) == 1 {
+				timer.Reset(c.config.BatchMaxWait)
+			}
+			if len(batch) < c.config.BatchSize {
+				continue
+			}
+
+		case <-timer.C:
+
+		case <-c.stopping:
+			// Пакет обрабатывается синхронно, поэтому в работе ничего нет;
+			// незавершённый пакет будет прочитан заново
+			return c.drainClaim(session, claim, drained, 0, len(batch))
+
+		case <-session.Context().Done():
+			return nil
+		}
+
+		stopTimer(timer)
+		if err := c.handleBatch(session, sub, handler, batch); err != nil {
+			if errors.Is(err, errPartitionStopped) {
+				if c.isStopping() {
+					return c.drainClaim(session, claim, drained, 0, len(batch))
+				}
+				return nil
+			}
+			return err
+		}
+		batch = batch[:0]
+	}
+}
+
+// stopTimer останавливает таймер и вычитывает уже сработавшее значение,
+// чтобы следующий Reset не сработал сразу
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+// handleBatch обрабатывает пакет и коммитит offset после его последнего сообщения.
+// Если пакет обработать не удалось, сообщения обрабатываются по одному: так ошибочное
+// сообщение уходит в топик повторов или DLQ, не задерживая остальные.
+func (c *Consumer) handleBatch(session sarama.ConsumerGroupSession, sub *subscription, handler BatchHandler, batch []*sarama.ConsumerMessage) error {
+	// Приостановленный консьюмер не начинает обработку новых пакетов
+	if err := c.waitResumed(session); err != nil {
+		return err
+	}
+
+	first, last := batch[0], batch[len(batch)-1]
+	fields := logrus.Fields{
+		"topic":        last.Topic,
+		"partition":    last.Partition,
+		"first_offset": first.Offset,
+		"last_offset":  last.Offset,
+		"batch_size":   len(batch),
+	}
+
+	outputs, tx, err := c.processBatch(session.Context(), sub, handler, batch)
+	if err == nil {
+		c.metrics.BatchSize.WithLabelValues(c.metrics.labels(last)...).Observe(float64(len(batch)))
+		if err := c.commitMessage(session, last, outputs, tx, last.Offset+1); err != nil {
+			c.logger.WithError(err).WithFields(fields).Error("Failed to commit batch, stopping partition until rebalance")
+			return err
+		}
+		return nil
+	}
+
+	if session.Context().Err() != nil {
+		return errPartitionStopped
+	}
+	c.logger.WithError(err).WithFields(fields).Warn("Batch processing failed, falling back to single messages")
+
+	for _, message := range batch {
+		// При остановке оставшиеся сообщения пакета не обрабатываем, их offset не закоммичен
+		if c.isStopping() {
+			return errPartitionStopped
+		}
+		outputs, tx, err := c.handleMessage(session, message)
+		if err == nil {
+			err = c.commitMessage(session, message, outputs, tx, message.Offset+1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processBatch обрабатывает пакет через BatchMiddleware из цепочки подписки. Как и
+// processMessage, возвращает выходные сообщения и открытую транзакцию обработчика.
+func (c *Consumer) processBatch(ctx context.Context, sub *subscription, handler BatchHandler, batch []*sarama.ConsumerMessage) ([]*sarama.ProducerMessage, *sql.Tx, error) {
+	ctx, outputs := withOutputBuffer(ctx)
+	ctx, handled := withHandlerTx(ctx, c.db)
+
+	next := func(ctx context.Context, messages []*sarama.ConsumerMessage) error {
+		outputs.reset()
+
+		// Транзакцию пакета уже открыл middleware, например DedupMiddleware
+		if tx, ok := handled.current(ctx); ok {
+			if err := handler.HandleBatch(ctx, messages); err != nil {
+				tx.Rollback()
+				handled.tx = nil
+				return err
+			}
+			return nil
+		}
+
+		handled.reset()
+		if c.db == nil {
+			return handler.HandleBatch(ctx, messages)
+		}
+
+		// Пакет пишется в одной транзакции и без offset store: иначе записи пакета, упавшего
+		// на середине, остались бы в базе и продублировались при обработке по одному.
+		// Транзакция сохраняется до вызова обработчика, чтобы её откатили и после паники
+		batchTx, err := handled.begin(ctx)
+		if err != nil {
+			return err
+		}
+		if err := handler.HandleBatch(withOffsetTx(ctx, batchTx), messages); err != nil {
+			batchTx.Rollback()
+			handled.tx = nil
+			return err
+		}
+		return nil
+	}
+
+	// Применяем пакетные middleware в обратном порядке: сначала общие, затем middleware подписки
+	middlewares := append(append([]Middleware{}, c.middlewares...), sub.middlewares...)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		middleware, ok := middlewares[i].(BatchMiddleware)
+		if !ok {
+			continue
+		}
+		currentNext := next
+		next = func(ctx context.Context, messages []*sarama.ConsumerMessage) error {
+			return middleware.ProcessBatch(ctx, messages, currentNext)
+		}
+	}
+
+	if err := next(ctx, batch); err != nil {
+		if handled.tx != nil {
+			handled.tx.Rollback()
+		}
+		return nil, nil, err
+	}
+	return outputs.messages, handled.tx, nil
+}
@@ -1,9 +1,13 @@
 package kafka
 
 import (
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Config содержит настройки для Kafka клиентов
@@ -13,64 +17,413 @@ type Config struct {
 	Topic             string        `yaml:"topic"`
 	RetryAttempts     int           `yaml:"retry_attempts"`
 	RetryDelay        time.Duration `yaml:"retry_delay"`
+	RetryMaxDelay     time.Duration `yaml:"retry_max_delay"`
+	RetryMaxElapsed   time.Duration `yaml:"retry_max_elapsed"`
 	ProcessingTimeout time.Duration `yaml:"processing_timeout"`
 	DLQTopic          string        `yaml:"dlq_topic"`
+	// TransactionalID — transactional.id продюсера пакетов, а для консьюмера в режиме
+	// Transactional - префикс ID продюсеров партиций (по умолчанию GroupID)
+	TransactionalID string `yaml:"transactional_id"`
+	// Transactional включает consume-transform-produce: выходные сообщения обработчика
+	// и offset входного сообщения коммитятся в одной транзакции Kafka
+	Transactional bool `yaml:"transactional"`
+	// OffsetStore включает хранение offset'ов в PostgreSQL: обработчик получает транзакцию
+	// через TxFromContext, и offset сообщения сохраняется в ней же
+	OffsetStore bool `yaml:"offset_store"`
+	// DedupRetention — сколько хранить записи inbox для DedupMiddleware
+	DedupRetention time.Duration `yaml:"dedup_retention"`
+	// FailurePolicy определяет, что делать с сообщением, которое не удалось ни обработать,
+	// ни отправить в DLQ
+	FailurePolicy FailurePolicy `yaml:"failure_policy"`
+	// Concurrency — число воркеров на партицию. Сообщения распределяются по ключу,
+	// порядок сохраняется в пределах ключа, offset коммитится до первого необработанного сообщения.
+	// Больше 1 несовместимо с OffsetStore и Transactional, см. Validate.
+	Concurrency int `yaml:"concurrency"`
+	// RetryTiers — топики отложенных повторов. Сообщение, которое не удалось обработать
+	// за RetryAttempts повторов в цикле партиции, уходит на следующий уровень, после последнего - в DLQ
+	RetryTiers []RetryTier `yaml:"retry_tiers"`
+	// BatchSize — максимальный размер пакета для обработчиков с BatchHandler, 0 или 1 - без пакетов.
+	// Пакетная партиция обрабатывается последовательно, Concurrency к ней не применяется.
+	BatchSize int `yaml:"batch_size"`
+	// BatchMaxWait — сколько ждать наполнения пакета после его первого сообщения
+	BatchMaxWait time.Duration `yaml:"batch_max_wait"`
+	// ShutdownTimeout — сколько Consumer.Shutdown ждёт сообщений, которые уже обрабатываются
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// HealthCheckInterval — как часто проверять зависимости консьюмера (PostgreSQL и
+	// добавленные через AddHealthChecker), он же таймаут проверки; 0 - не проверять
+	HealthCheckInterval time.Duration `yaml:"health_check_interval"`
+	// Registerer — реестр метрик консьюмера, nil - prometheus.DefaultRegisterer.
+	// Отдельный реестр нужен тестам и процессам с несколькими консьюмерами.
+	Registerer prometheus.Registerer `yaml:"-"`
+	// Version — версия протокола Kafka, например "2.8.0"
+	Version string `yaml:"version"`
+	// Producer — настройки продюсеров sarama
+	Producer ProducerSettings `yaml:"producer"`
+	// Consumer — настройки консьюмер-группы sarama
+	Consumer ConsumerSettings `yaml:"consumer"`
+	// TLS и SASL — защищённое подключение к брокерам, общее для всех клиентов
+	TLS  TLSSettings  `yaml:"tls"`
+	SASL SASLSettings `yaml:"sasl"`
+}
+
+// ProducerSettings содержит настройки продюсеров: основного, DLQ и транзакционного
+type ProducerSettings struct {
+	// RequiredAcks — подтверждения записи: all, leader или none. Идемпотентный продюсер требует all.
+	RequiredAcks string `yaml:"required_acks"`
+	// RetryMax — число повторов отправки
+	RetryMax int `yaml:"retry_max"`
+	// Compression — сжатие: none, gzip, snappy, lz4 или zstd
+	Compression string `yaml:"compression"`
+	// FlushMessages — сколько сообщений копить перед отправкой
+	FlushMessages int `yaml:"flush_messages"`
+	// TransactionTimeout — таймаут транзакции Kafka
+	TransactionTimeout time.Duration `yaml:"transaction_timeout"`
+}
+
+// ConsumerSettings содержит настройки консьюмер-группы
+type ConsumerSettings struct {
+	// InitialOffset — откуда читать партицию без закоммиченного offset'а: newest или oldest
+	InitialOffset string `yaml:"initial_offset"`
+	// RebalanceStrategy — стратегии распределения партиций через запятую в порядке приоритета:
+	// roundrobin, range, sticky. Несколько стратегий нужны при смене стратегии работающей группы.
+	// cooperative-sticky недоступна: sarama v1.38.1 не умеет инкрементальную ребалансировку
+	// (KIP-429), и ближайшая замена - sticky, которая сохраняет распределение, но отзывает все партиции.
+	RebalanceStrategy string        `yaml:"rebalance_strategy"`
+	RebalanceTimeout  time.Duration `yaml:"rebalance_timeout"`
+	SessionTimeout    time.Duration `yaml:"session_timeout"`
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	// CommitInterval — как часто отмеченные offset'ы коммитятся в Kafka, кроме коммита
+	// при завершении сессии. Определяет, сколько сообщений будет прочитано заново после падения.
+	CommitInterval time.Duration `yaml:"commit_interval"`
+}
+
+// FailurePolicy — политика для сообщений, которые не удалось обработать и сохранить в DLQ
+type FailurePolicy string
+
+const (
+	// FailurePolicyBlock повторяет обработку, пока она не удастся; партиция стоит
+	FailurePolicyBlock FailurePolicy = "block"
+	// FailurePolicyPause останавливает чтение партиции до ребалансировки
+	FailurePolicyPause FailurePolicy = "pause"
+	// FailurePolicyCrash останавливает консьюмер, Start возвращает ошибку
+	FailurePolicyCrash FailurePolicy = "crash"
+	// FailurePolicySkip коммитит offset и теряет сообщение
+	FailurePolicySkip FailurePolicy = "skip"
+)
+
+// valid проверяет, что политика известна
+func (p FailurePolicy) valid() bool {
+	switch p {
+	case FailurePolicyBlock, FailurePolicyPause, FailurePolicyCrash, FailurePolicySkip:
+		return true
+	}
+	return false
 }
 
 // DefaultConfig возвращает конфигурацию по умолчанию
 func DefaultConfig() *Config {
 	return &Config{
-		Brokers:           []string{"localhost:9092", "localhost:9093", "localhost:9094"},
-		RetryAttempts:     3,
-		RetryDelay:        time.Second * 2,
-		ProcessingTimeout: time.Second * 30,
+		Brokers:             []string{"localhost:9092", "localhost:9093", "localhost:9094"},
+		RetryAttempts:       3,
+		RetryDelay:          time.Second * 2,
+		RetryMaxDelay:       time.Second * 30,
+		RetryMaxElapsed:     time.Minute * 2,
+		ProcessingTimeout:   time.Second * 30,
+		DedupRetention:      time.Hour * 24 * 7,
+		FailurePolicy:       FailurePolicyBlock,
+		Concurrency:         1,
+		BatchMaxWait:        time.Millisecond * 500,
+		ShutdownTimeout:     time.Second * 30,
+		HealthCheckInterval: time.Second * 5,
+		Version:             "2.8.0",
+		Producer: ProducerSettings{
+			RequiredAcks:       "all",
+			RetryMax:           5,
+			Compression:        "snappy",
+			FlushMessages:      1,
+			TransactionTimeout: time.Second * 30,
+		},
+		Consumer: ConsumerSettings{
+			InitialOffset:     "newest",
+			RebalanceStrategy: "roundrobin",
+			RebalanceTimeout:  time.Second * 60,
+			SessionTimeout:    time.Second * 10,
+			HeartbeatInterval: time.Second * 3,
+			CommitInterval:    time.Second,
+		},
+	}
+}
+
+// Validate проверяет настройки, общие для всех клиентов
+func (c *Config) Validate() error {
+	if len(c.Brokers) == 0 {
+		return fmt.Errorf("kafka brokers are required")
+	}
+	if c.FailurePolicy != "" && !c.FailurePolicy.valid() {
+		return fmt.Errorf("unknown failure policy %q", c.FailurePolicy)
+	}
+	if err := c.validateConcurrency(); err != nil {
+		return err
+	}
+	if _, err := c.ProducerConfig(); err != nil {
+		return err
+	}
+	if _, err := c.ConsumerConfig(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateConcurrency проверяет, что параллельная обработка партиции совместима с режимом
+// коммита. Сообщение, завершённое раньше предыдущих, не сдвигает offset, поэтому в режимах
+// OffsetStore и Transactional его результаты коммитились бы без offset'а и повторялись
+// после ребалансировки.
+func (c *Config) validateConcurrency() error {
+	if c.Concurrency > 1 && (c.OffsetStore || c.Transactional) {
+		return fmt.Errorf("concurrency %d is not supported with offset store or transactional mode", c.Concurrency)
+	}
+	return nil
+}
+
+// RetryPolicy возвращает политику повторов RetryMiddleware: задержка удваивается
+// от RetryDelay до RetryMaxDelay с разбросом ±20%
+func (c *Config) RetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:     c.RetryAttempts,
+		InitialDelay:   c.RetryDelay,
+		MaxDelay:       c.RetryMaxDelay,
+		Multiplier:     2,
+		Jitter:         0.2,
+		MaxElapsedTime: c.RetryMaxElapsed,
 	}
 }
 
-// NewProducerConfig создаёт конфигурацию для продюсера с exactly-once семантикой
+// defaultTransactionalIDPrefix — префикс transactional.id, если он не задан в конфигурации
+const defaultTransactionalIDPrefix = "insurance-producer"
+
+// NewTransactionalID возвращает transactional.id экземпляра сервиса: префикс и имя хоста
+// (пода). ID постоянный, поэтому перезапущенный экземпляр вытесняет (fence) незавершённые
+// транзакции прежнего, а реплики с разными именами не мешают друг другу.
+func NewTransactionalID(prefix string) string {
+	if prefix == "" {
+		prefix = defaultTransactionalIDPrefix
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("%s-%s", prefix, hostname)
+}
+
+// NewProducerConfig создаёт конфигурацию продюсера с настройками по умолчанию
 func NewProducerConfig() *sarama.Config {
+	return mustSaramaConfig(DefaultConfig().ProducerConfig())
+}
+
+// NewTransactionalProducerConfig создаёт конфигурацию транзакционного продюсера
+// с настройками по умолчанию, см. Config.TransactionalProducerConfig
+func NewTransactionalProducerConfig(transactionalID string) *sarama.Config {
+	return mustSaramaConfig(DefaultConfig().TransactionalProducerConfig(transactionalID))
+}
+
+// NewConsumerConfig создаёт конфигурацию консьюмера с настройками по умолчанию
+func NewConsumerConfig(groupID string) *sarama.Config {
+	config := DefaultConfig()
+	config.GroupID = groupID
+	return mustSaramaConfig(config.ConsumerConfig())
+}
+
+// mustSaramaConfig возвращает конфигурацию, построенную из настроек по умолчанию:
+// они всегда корректны
+func mustSaramaConfig(config *sarama.Config, err error) *sarama.Config {
+	if err != nil {
+		panic(err)
+	}
+	return config
+}
+
+// ProducerConfig создаёт конфигурацию для продюсера с exactly-once семантикой
+func (c *Config) ProducerConfig() (*sarama.Config, error) {
 	config := sarama.NewConfig()
 
+	version, err := c.version()
+	if err != nil {
+		return nil, err
+	}
+	config.Version = version
+
+	acks, err := parseRequiredAcks(c.Producer.RequiredAcks)
+	if err != nil {
+		return nil, err
+	}
+	compression, err := parseCompression(c.Producer.Compression)
+	if err != nil {
+		return nil, err
+	}
+
 	// Exactly-once настройки
-	config.Producer.Idempotent = true                // Идемпотентный продюсер
-	config.Producer.RequiredAcks = sarama.WaitForAll // Ждём подтверждения от всех реплик
-	config.Producer.Retry.Max = 5                    // Максимум повторов
-	config.Producer.Return.Successes = true          // Возвращаем успешные отправки
-	config.Producer.Return.Errors = true             // Возвращаем ошибки
-	config.Producer.Flush.Messages = 1               // Отправляем сразу
+	config.Producer.Idempotent = true                         // Идемпотентный продюсер
+	config.Producer.RequiredAcks = acks                       // По умолчанию ждём подтверждения от всех реплик
+	config.Producer.Retry.Max = c.Producer.RetryMax           // Максимум повторов
+	config.Producer.Return.Successes = true                   // Возвращаем успешные отправки
+	config.Producer.Return.Errors = true                      // Возвращаем ошибки
+	config.Producer.Flush.Messages = c.Producer.FlushMessages // По умолчанию отправляем сразу
+	config.Net.MaxOpenRequests = 1                            // Идемпотентность требует одного запроса в полёте
 
 	// Партиционирование
 	config.Producer.Partitioner = sarama.NewHashPartitioner
 
-	// Настройки для транзакций
-	config.Producer.Transaction.ID = "insurance-producer"
-	config.Producer.Transaction.Timeout = time.Second * 30
-
 	// Компрессия для производительности
-	config.Producer.Compression = sarama.CompressionSnappy
+	config.Producer.Compression = compression
 
-	// Версия протокола
-	config.Version = sarama.V2_8_0_0
+	if err := c.applySecurity(config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid producer config: %w", err)
+	}
+	return config, nil
+}
 
-	return config
+// TransactionalProducerConfig создаёт конфигурацию транзакционного продюсера.
+// transactionalID должен быть постоянным и уникальным для каждого экземпляра или партиции,
+// см. NewTransactionalID и PartitionTransactionalID.
+func (c *Config) TransactionalProducerConfig(transactionalID string) (*sarama.Config, error) {
+	config, err := c.ProducerConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// Настройки для транзакций
+	config.Producer.Transaction.ID = transactionalID
+	config.Producer.Transaction.Timeout = c.Producer.TransactionTimeout
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid transactional producer config: %w", err)
+	}
+	return config, nil
 }
 
-// NewConsumerConfig создаёт конфигурацию для консьюмера
-func NewConsumerConfig(groupID string) *sarama.Config {
+// ConsumerConfig создаёт конфигурацию для консьюмера
+func (c *Config) ConsumerConfig() (*sarama.Config, error) {
 	config := sarama.NewConfig()
 
+	version, err := c.version()
+	if err != nil {
+		return nil, err
+	}
+	config.Version = version
+
+	initial, err := parseInitialOffset(c.Consumer.InitialOffset)
+	if err != nil {
+		return nil, err
+	}
+	strategies, err := parseRebalanceStrategies(c.Consumer.RebalanceStrategy)
+	if err != nil {
+		return nil, err
+	}
+
 	// Exactly-once настройки для консьюмера
-	config.Consumer.Offsets.Initial = sarama.OffsetNewest
-	config.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRoundRobin
-	config.Consumer.Group.Rebalance.Timeout = time.Second * 60
-	config.Consumer.Group.Session.Timeout = time.Second * 10
-	config.Consumer.Group.Heartbeat.Interval = time.Second * 3
+	config.Consumer.Offsets.Initial = initial
+	config.Consumer.Group.Rebalance.GroupStrategies = strategies
+	config.Consumer.Group.Rebalance.Timeout = c.Consumer.RebalanceTimeout
+	config.Consumer.Group.Session.Timeout = c.Consumer.SessionTimeout
+	config.Consumer.Group.Heartbeat.Interval = c.Consumer.HeartbeatInterval
 
-	// Отключаем автокоммит - будем коммитить вручную после обработки
-	config.Consumer.Offsets.AutoCommit.Enable = false
+	// Автокоммит коммитит только offset'ы, отмеченные после обработки (MarkOffset),
+	// и не даёт потерять прогресс при падении между ребалансировками
+	config.Consumer.Offsets.AutoCommit.Enable = true
+	config.Consumer.Offsets.AutoCommit.Interval = c.Consumer.CommitInterval
 
-	// Версия протокола
-	config.Version = sarama.V2_8_0_0
+	// Читаем только закоммиченные транзакции: сообщения прерванных пакетов не видны
+	config.Consumer.IsolationLevel = sarama.ReadCommitted
 
-	return config
+	if err := c.applySecurity(config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid consumer config: %w", err)
+	}
+	return config, nil
+}
+
+// version разбирает версию протокола Kafka
+func (c *Config) version() (sarama.KafkaVersion, error) {
+	version, err := sarama.ParseKafkaVersion(c.Version)
+	if err != nil {
+		return sarama.KafkaVersion{}, fmt.Errorf("invalid kafka version %q: %w", c.Version, err)
+	}
+	return version, nil
+}
+
+// parseRequiredAcks разбирает уровень подтверждений продюсера
+func parseRequiredAcks(value string) (sarama.RequiredAcks, error) {
+	switch value {
+	case "all":
+		return sarama.WaitForAll, nil
+	case "leader":
+		return sarama.WaitForLocal, nil
+	case "none":
+		return sarama.NoResponse, nil
+	}
+	return 0, fmt.Errorf("unknown required acks %q, expected all, leader or none", value)
+}
+
+// parseCompression разбирает кодек сжатия продюсера
+func parseCompression(value string) (sarama.CompressionCodec, error) {
+	switch value {
+	case "none":
+		return sarama.CompressionNone, nil
+	case "gzip":
+		return sarama.CompressionGZIP, nil
+	case "snappy":
+		return sarama.CompressionSnappy, nil
+	case "lz4":
+		return sarama.CompressionLZ4, nil
+	case "zstd":
+		return sarama.CompressionZSTD, nil
+	}
+	return 0, fmt.Errorf("unknown compression %q, expected none, gzip, snappy, lz4 or zstd", value)
+}
+
+// parseInitialOffset разбирает начальный offset консьюмера
+func parseInitialOffset(value string) (int64, error) {
+	switch value {
+	case "newest":
+		return sarama.OffsetNewest, nil
+	case "oldest":
+		return sarama.OffsetOldest, nil
+	}
+	return 0, fmt.Errorf("unknown initial offset %q, expected newest or oldest", value)
+}
+
+// parseRebalanceStrategies разбирает список стратегий распределения партиций
+func parseRebalanceStrategies(value string) ([]sarama.BalanceStrategy, error) {
+	var strategies []sarama.BalanceStrategy
+	for _, name := range strings.Split(value, ",") {
+		strategy, err := parseRebalanceStrategy(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		strategies = append(strategies, strategy)
+	}
+	return strategies, nil
+}
+
+// parseRebalanceStrategy разбирает стратегию распределения партиций
+func parseRebalanceStrategy(value string) (sarama.BalanceStrategy, error) {
+	switch value {
+	case "roundrobin":
+		return sarama.BalanceStrategyRoundRobin, nil
+	case "range":
+		return sarama.BalanceStrategyRange, nil
+	case "sticky":
+		return sarama.BalanceStrategySticky, nil
+	case "cooperative-sticky":
+		// Sarama v1.38.1 поддерживает только eager-протокол: все партиции отзываются при каждой ребалансировке
+		return nil, fmt.Errorf("rebalance strategy cooperative-sticky is not supported by the kafka client, use sticky")
+	}
+	return nil, fmt.Errorf("unknown rebalance strategy %q, expected roundrobin, range or sticky", value)
 }
@@ -4,12 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Shopify/sarama"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/sirupsen/logrus"
 )
 
@@ -26,119 +27,217 @@ type Middleware interface {
 
 // Consumer представляет Kafka консьюмер с расширенными возможностями
 type Consumer struct {
-	config      *Config
-	handler     MessageHandler
-	middlewares []Middleware
-	logger      *logrus.Logger
-	db          *sql.DB
-	producer    sarama.SyncProducer
-	metrics     *ConsumerMetrics
-}
+	config        *Config
+	subscriptions []*subscription
+	middlewares   []Middleware
+	logger        *logrus.Logger
+	db            *sql.DB
+	producer      sarama.SyncProducer
+	txnProducers  *transactionalProducers // Только в режиме Config.Transactional
+	offsets       *offsetStore
+	lag           *lagTracker
+	assigned      atomic.Int32 // Число партиций активной сессии консьюмер-группы
+	metrics       *ConsumerMetrics
+	crash         context.CancelCauseFunc
+
+	// Хуки ребалансировки, см. OnPartitionsAssigned и OnPartitionsRevoked
+	assignedHooks    []AssignmentHook
+	revokedHooks     []AssignmentHook
+	rebalanceStarted time.Time // Setup и Cleanup вызываются в горутине Start
+
+	// Плавная остановка, см. Shutdown
+	stopping chan struct{} // Закрывается в начале Shutdown
+	stopOnce sync.Once
+	runMu    sync.Mutex
+	run      *consumerRun
+	claims   sync.WaitGroup // Партиции, обработку которых дожидается Shutdown
 
-// ConsumerMetrics содержит метрики для мониторинга
-type ConsumerMetrics struct {
-	MessagesProcessed prometheus.Counter
-	ProcessingTime    prometheus.Histogram
-	Errors            prometheus.Counter
-	Retries           prometheus.Counter
-	DLQMessages       prometheus.Counter
-	Lag               prometheus.Gauge
+	// Приостановка, см. Pause и AddHealthChecker
+	pauses   *pauseState
+	checkers []namedChecker
+
+	failurePolicy FailurePolicy
 }
 
+// errPartitionStopped возвращается, когда партицию нельзя читать дальше до ребалансировки
+var errPartitionStopped = errors.New("kafka: partition stopped")
+
 // NewConsumer создаёт новый консьюмер
 func NewConsumer(config *Config, handler MessageHandler, db *sql.DB, logger *logrus.Logger) (*Consumer, error) {
+	// Ошибки конфигурации, в том числе настроек консьюмер-группы, видны сразу, а не при подключении в Start
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid kafka config: %w", err)
+	}
+	failurePolicy := config.FailurePolicy
+	if failurePolicy == "" {
+		failurePolicy = FailurePolicyBlock
+	}
+
 	// Создаём продюсер для DLQ
-	producerConfig := NewProducerConfig()
+	producerConfig, err := config.ProducerConfig()
+	if err != nil {
+		return nil, err
+	}
 	producer, err := sarama.NewSyncProducer(config.Brokers, producerConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create producer: %w", err)
 	}
 
 	// Инициализируем метрики
-	metrics := &ConsumerMetrics{
-		MessagesProcessed: promauto.NewCounter(prometheus.CounterOpts{
-			Name: "kafka_messages_processed_total",
-			Help: "Total number of processed messages",
-			ConstLabels: prometheus.Labels{
-				"topic": handler.GetTopic(),
-			},
-		}),
-		ProcessingTime: promauto.NewHistogram(prometheus.HistogramOpts{
-			Name: "kafka_message_processing_duration_seconds",
-			Help: "Time spent processing messages",
-			ConstLabels: prometheus.Labels{
-				"topic": handler.GetTopic(),
-			},
-		}),
-		Errors: promauto.NewCounter(prometheus.CounterOpts{
-			Name: "kafka_processing_errors_total",
-			Help: "Total number of processing errors",
-			ConstLabels: prometheus.Labels{
-				"topic": handler.GetTopic(),
-			},
-		}),
-		Retries: promauto.NewCounter(prometheus.CounterOpts{
-			Name: "kafka_retries_total",
-			Help: "Total number of retries",
-			ConstLabels: prometheus.Labels{
-				"topic": handler.GetTopic(),
-			},
-		}),
-		DLQMessages: promauto.NewCounter(prometheus.CounterOpts{
-			Name: "kafka_dlq_messages_total",
-			Help: "Total number of messages sent to DLQ",
-			ConstLabels: prometheus.Labels{
-				"topic": handler.GetTopic(),
-			},
-		}),
-		Lag: promauto.NewGauge(prometheus.GaugeOpts{
-			Name: "kafka_consumer_lag",
-			Help: "Consumer lag",
-			ConstLabels: prometheus.Labels{
-				"topic": handler.GetTopic(),
-			},
-		}),
+	metrics, err := NewConsumerMetrics(config.Registerer, config.GroupID)
+	if err != nil {
+		producer.Close()
+		return nil, err
 	}
 
 	consumer := &Consumer{
-		config:   config,
-		handler:  handler,
-		logger:   logger,
-		db:       db,
-		producer: producer,
-		metrics:  metrics,
+		config:        config,
+		logger:        logger,
+		db:            db,
+		producer:      producer,
+		metrics:       metrics,
+		lag:           newLagTracker(config.GroupID, metrics.Lag),
+		stopping:      make(chan struct{}),
+		pauses:        newPauseState(),
+		failurePolicy: failurePolicy,
 	}
 
+	// Пока база недоступна, сообщения ждут в Kafka, а не уходят в DLQ
+	if db != nil {
+		consumer.AddHealthChecker("postgres", NewDBHealthChecker(db))
+	}
+
+	// Offset'ы в PostgreSQL, в одной транзакции с изменениями обработчика
+	if config.OffsetStore {
+		if db == nil {
+			producer.Close()
+			return nil, fmt.Errorf("offset store requires a database connection")
+		}
+		consumer.offsets = newOffsetStore(db, config.GroupID)
+	}
+
+	// Транзакционные продюсеры для consume-transform-produce, по одному на партицию
+	if config.Transactional {
+		prefix := config.TransactionalID
+		if prefix == "" {
+			prefix = config.GroupID
+		}
+		// Продюсеры создаются при первой транзакции партиции, конфигурацию проверяем сразу
+		if _, err := config.TransactionalProducerConfig(prefix); err != nil {
+			producer.Close()
+			return nil, err
+		}
+		consumer.txnProducers = newTransactionalProducers(config, prefix, logger)
+
+		logger.WithField("transactional_id_prefix", prefix).Info("Consumer runs in transactional mode")
+	}
+
+	// Основной топик консьюмера, остальные добавляются через Subscribe и SubscribePattern
+	topic := config.Topic
+	if topic == "" {
+		topic = handler.GetTopic()
+	}
+	consumer.Subscribe(topic, handler)
+
 	// Добавляем стандартные middleware
 	consumer.Use(NewLoggingMiddleware(logger))
 	consumer.Use(NewMetricsMiddleware(metrics))
-	consumer.Use(NewRetryMiddleware(config.RetryAttempts, config.RetryDelay, logger))
+	// Первая ступень повторов - короткие повторы в цикле партиции по RetryPolicy.
+	// Если они не помогли, сообщение откладывается в топики повторов RetryTiers или DLQ.
+	consumer.Use(NewRetryMiddleware(config.RetryPolicy(), logger))
+	// Таймаут на каждую попытку: зависший запрос к базе не останавливает партицию навсегда
+	if config.ProcessingTimeout > 0 {
+		consumer.Use(NewTimeoutMiddleware(config.ProcessingTimeout, metrics, logger))
+	}
+	// Паника обработчика отправляет сообщение в DLQ, а не роняет процесс
+	consumer.Use(NewRecoveryMiddleware(metrics, logger))
+
+	logger.WithField("failure_policy", failurePolicy).Info("Consumer created")
 
 	return consumer, nil
 }
 
-// Use добавляет middleware
+// Use добавляет middleware, общий для всех подписок консьюмера
 func (c *Consumer) Use(middleware Middleware) {
 	c.middlewares = append(c.middlewares, middleware)
 }
 
-// Start запускает консьюмер
+// Start запускает консьюмер. Отмена ctx останавливает его сразу, прерывая обработку;
+// для плавной остановки используйте Shutdown.
 func (c *Consumer) Start(ctx context.Context) error {
-	consumerConfig := NewConsumerConfig(c.config.GroupID)
-	consumerGroup, err := sarama.NewConsumerGroup(c.config.Brokers, c.config.GroupID, consumerConfig)
+	// Shutdown дожидается закрытия консьюмер-группы
+	done := make(chan struct{})
+	defer close(done)
+
+	consumerConfig, err := c.config.ConsumerConfig()
+	if err != nil {
+		return err
+	}
+	client, err := sarama.NewClient(c.config.Brokers, consumerConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create kafka client: %w", err)
+	}
+
+	// ClusterAdmin закрывает клиент вместе с собой
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		client.Close()
+		return fmt.Errorf("failed to create cluster admin: %w", err)
+	}
+	defer admin.Close()
+
+	consumerGroup, err := sarama.NewConsumerGroupFromClient(c.config.GroupID, client)
 	if err != nil {
 		return fmt.Errorf("failed to create consumer group: %w", err)
 	}
 	defer consumerGroup.Close()
 
+	// Политика FailurePolicyCrash останавливает консьюмер через отмену контекста
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	c.crash = cancel
+
+	if !c.register(&consumerRun{group: consumerGroup, cancel: cancel, done: done}) {
+		c.logger.Info("Consumer is shutting down, not starting")
+		return nil
+	}
+
+	// Лаг простаивающих партиций, из которых не приходят сообщения
+	go c.collectLag(ctx, client, admin)
+	go c.monitorHealth(ctx)
+
+	// Первая ребалансировка - вход в группу
+	c.rebalanceStarted = time.Now()
+
 	// Запускаем обработку сообщений
 	for {
 		select {
 		case <-ctx.Done():
+			if cause := context.Cause(ctx); cause != ctx.Err() {
+				c.logger.WithError(cause).Error("Consumer crashed")
+				return cause
+			}
 			c.logger.Info("Consumer context cancelled")
 			return nil
+		case <-c.stopping:
+			c.logger.Info("Consumer stopped")
+			return nil
 		default:
-			err := consumerGroup.Consume(ctx, []string{c.config.Topic}, c)
+			topics, err := c.topics(client)
+			if err != nil {
+				c.logger.WithError(err).Error("Failed to resolve topic subscription")
+				return err
+			}
+
+			// При изменении списка топиков по шаблону сессия завершается,
+			// и консьюмер заново входит в группу с новым списком
+			sessionCtx, resubscribe := context.WithCancel(ctx)
+			if c.hasPatterns() {
+				go c.watchTopics(sessionCtx, client, topics, resubscribe)
+			}
+
+			err = consumerGroup.Consume(sessionCtx, topics, c)
+			resubscribe()
 			if err != nil {
 				c.logger.WithError(err).Error("Error from consumer")
 				return err
@@ -147,44 +246,125 @@ func (c *Consumer) Start(ctx context.Context) error {
 	}
 }
 
+// AssignedPartitions возвращает число партиций, назначенных консьюмеру в активной сессии.
+// Вне сессии (до входа в группу, во время ребалансировки) возвращает 0.
+func (c *Consumer) AssignedPartitions() int {
+	return int(c.assigned.Load())
+}
+
 // Setup реализует интерфейс sarama.ConsumerGroupHandler
-func (c *Consumer) Setup(sarama.ConsumerGroupSession) error {
-	c.logger.Info("Consumer group session started")
+func (c *Consumer) Setup(session sarama.ConsumerGroupSession) error {
+	// Продолжаем чтение с offset'ов, сохранённых в PostgreSQL
+	if c.offsets != nil {
+		for topic, partitions := range session.Claims() {
+			offsets, err := c.offsets.load(session.Context(), topic, partitions)
+			if err != nil {
+				return err
+			}
+
+			for partition, offset := range offsets {
+				seek(session, topic, partition, offset)
+				c.logger.WithFields(logrus.Fields{
+					"topic":     topic,
+					"partition": partition,
+					"offset":    offset,
+				}).Info("Partition offset restored from database")
+			}
+		}
+	}
+
+	// Хуки могут переопределить offset'ы, например из внешнего хранилища
+	if err := c.partitionsAssigned(session); err != nil {
+		return err
+	}
+
+	c.lag.assign(session.Claims())
+
+	assigned := 0
+	for _, partitions := range session.Claims() {
+		assigned += len(partitions)
+	}
+	c.assigned.Store(int32(assigned))
+
+	c.logger.WithFields(logrus.Fields{
+		"member_id":  session.MemberID(),
+		"generation": session.GenerationID(),
+		"partitions": assigned,
+	}).Info("Consumer group session started")
 	return nil
 }
 
-// Cleanup реализует интерфейс sarama.ConsumerGroupHandler
-func (c *Consumer) Cleanup(sarama.ConsumerGroupSession) error {
+// Cleanup реализует интерфейс sarama.ConsumerGroupHandler. Отмеченные offset'ы
+// коммитятся каждые Consumer.CommitInterval и здесь, при завершении сессии:
+// при ребалансировке и остановке после дренажа.
+func (c *Consumer) Cleanup(session sarama.ConsumerGroupSession) error {
+	// Хуки отзыва могут отметить offset'ы сброшенных буферов до коммита
+	c.partitionsRevoked(session)
+	session.Commit()
+
+	// Продюсеры партиций закрываются: новый владелец создаст продюсер с тем же transactional.id
+	if c.txnProducers != nil {
+		if err := c.txnProducers.close(); err != nil {
+			c.logger.WithError(err).Error("Failed to close transactional producers")
+		}
+	}
+
+	c.assigned.Store(0)
+	c.lag.revoke()
 	c.logger.Info("Consumer group session ended")
 	return nil
 }
 
-// ConsumeClaim реализует интерфейс sarama.ConsumerGroupHandler
+// ConsumeClaim реализует интерфейс sarama.ConsumerGroupHandler. Сообщения партиции
+// обрабатываются Config.Concurrency воркерами, сообщения одного ключа - по порядку,
+// а для пакетных обработчиков - пакетами, см. BatchHandler.
 func (c *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	// Консьюмер останавливается: партицию не читаем, сессию завершит Shutdown
+	if !c.claimStarted() {
+		<-session.Context().Done()
+		return nil
+	}
+	drained := sync.OnceFunc(c.claims.Done)
+	defer drained()
+
+	// Новая сессия приостановленного консьюмера не читает партицию до Resume
+	c.pauseClaim(claim)
+
+	// Обработчики с BatchHandler получают сообщения партиции пакетами
+	if sub, handler := c.batchHandler(claim.Topic()); handler != nil {
+		return c.consumeBatches(session, claim, sub, handler, drained)
+	}
+
+	workers := newClaimWorkers(c, session, c.config.Concurrency)
+	defer workers.stop()
+
 	for {
 		select {
 		case message := <-claim.Messages():
 			if message == nil {
 				return nil
 			}
+			c.lag.observe(message.Topic, message.Partition, claim.HighWaterMarkOffset())
 
-			// Обрабатываем сообщение через middleware chain
-			err := c.processMessage(session.Context(), message)
-			if err != nil {
-				c.logger.WithError(err).WithFields(logrus.Fields{
-					"topic":     message.Topic,
-					"partition": message.Partition,
-					"offset":    message.Offset,
-				}).Error("Failed to process message")
-
-				// Отправляем в DLQ если все попытки исчерпаны
-				if c.config.DLQTopic != "" {
-					c.sendToDLQ(message, err)
+			// Сообщения уровня повторов отдаём воркерам только после задержки
+			if !c.waitRetryDue(session, message) {
+				if c.isStopping() {
+					inFlight, skipped := workers.drain()
+					return c.drainClaim(session, claim, drained, inFlight, skipped+1)
 				}
+				return nil
 			}
 
-			// Коммитим offset только после успешной обработки
-			session.MarkOffset(message.Topic, message.Partition, message.Offset+1, "")
+			if !workers.dispatch(message) {
+				return workers.failure()
+			}
+
+		case err := <-workers.errors:
+			return err
+
+		case <-c.stopping:
+			inFlight, skipped := workers.drain()
+			return c.drainClaim(session, claim, drained, inFlight, skipped)
 
 		case <-session.Context().Done():
 			return nil
@@ -192,40 +372,282 @@ func (c *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim saram
 	}
 }
 
-// processMessage обрабатывает сообщение через цепочку middleware
-func (c *Consumer) processMessage(ctx context.Context, message *sarama.ConsumerMessage) error {
-	// Создаём цепочку middleware
+// handleMessage обрабатывает сообщение через middleware chain и при ошибке применяет
+// политику отказов. Offset коммитится, только если сообщение в итоге обработано
+// или сохранено в DLQ.
+func (c *Consumer) handleMessage(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage) ([]*sarama.ProducerMessage, *sql.Tx, error) {
+	// Повторы других консьюмер-групп только коммитим
+	if c.isForeignRetry(message) {
+		return nil, nil, nil
+	}
+
+	outputs, tx, err := c.processMessage(session.Context(), message)
+	if err != nil {
+		return c.handleFailure(session, message, err)
+	}
+	return outputs, tx, nil
+}
+
+// processMessage обрабатывает сообщение через цепочку middleware и возвращает
+// выходные сообщения, переданные обработчиком через Emit. В режиме offset store
+// возвращается и открытая транзакция обработчика, её коммитит commitMessage.
+func (c *Consumer) processMessage(ctx context.Context, message *sarama.ConsumerMessage) ([]*sarama.ProducerMessage, *sql.Tx, error) {
+	sub, err := c.messageSubscription(message)
+	if err != nil {
+		return nil, nil, &attemptsError{err: err, attempts: 1}
+	}
+
+	ctx, outputs := withOutputBuffer(ctx)
+	ctx, handled := withHandlerTx(ctx, c.db)
+	attempts := 0
+
+	// Создаём цепочку middleware; при повторе результаты прошлой попытки отбрасываются
 	var next func(context.Context, *sarama.ConsumerMessage) error
-	next = c.handler.Handle
+	next = func(ctx context.Context, msg *sarama.ConsumerMessage) error {
+		outputs.reset()
+		attempts++
+
+		// Транзакцию попытки уже открыл middleware, например DedupMiddleware
+		if tx, ok := handled.current(ctx); ok {
+			if err := sub.handler.Handle(ctx, msg); err != nil {
+				tx.Rollback()
+				handled.tx = nil
+				return err
+			}
+			return nil
+		}
+
+		handled.reset()
+		if c.offsets == nil {
+			return sub.handler.Handle(ctx, msg)
+		}
+
+		// Транзакция сохраняется до вызова обработчика, чтобы её откатили и после паники
+		attemptTx, err := handled.begin(ctx)
+		if err != nil {
+			return err
+		}
+		if err := sub.handler.Handle(withOffsetTx(ctx, attemptTx), msg); err != nil {
+			attemptTx.Rollback()
+			handled.tx = nil
+			return err
+		}
+		return nil
+	}
 
-	// Применяем middleware в обратном порядке
-	for i := len(c.middlewares) - 1; i >= 0; i-- {
-		middleware := c.middlewares[i]
+	// Применяем middleware в обратном порядке: сначала общие, затем middleware подписки
+	middlewares := append(append([]Middleware{}, c.middlewares...), sub.middlewares...)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		middleware := middlewares[i]
 		currentNext := next
 		next = func(ctx context.Context, msg *sarama.ConsumerMessage) error {
 			return middleware.Process(ctx, msg, currentNext)
 		}
 	}
 
-	return next(ctx, message)
+	if err := next(ctx, message); err != nil {
+		if handled.tx != nil {
+			// Успешную попытку отменил middleware, её изменения не сохраняем
+			handled.tx.Rollback()
+		}
+		return nil, nil, &attemptsError{err: err, attempts: attempts}
+	}
+	return outputs.messages, handled.tx, nil
 }
 
-// sendToDLQ отправляет сообщение в Dead Letter Queue
-func (c *Consumer) sendToDLQ(originalMessage *sarama.ConsumerMessage, processingError error) {
-	dlqMessage := &DLQMessage{
-		OriginalTopic:     originalMessage.Topic,
-		OriginalPartition: originalMessage.Partition,
-		OriginalOffset:    originalMessage.Offset,
-		OriginalKey:       string(originalMessage.Key),
-		OriginalValue:     string(originalMessage.Value),
-		Error:             processingError.Error(),
-		Timestamp:         time.Now(),
+// handleFailure откладывает необработанное сообщение в топик повторов или DLQ, а если
+// это не удалось - применяет политику FailurePolicy. Возвращает nil, если offset можно
+// коммитить: сообщение отложено, пропущено
+// или обработано повторно (тогда возвращаются и результаты обработки).
+func (c *Consumer) handleFailure(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage, processingErr error) ([]*sarama.ProducerMessage, *sql.Tx, error) {
+	attempts := errorAttempts(processingErr)
+
+	for {
+		fields := logrus.Fields{
+			"topic":          message.Topic,
+			"partition":      message.Partition,
+			"offset":         message.Offset,
+			"failure_policy": c.failurePolicy,
+		}
+		c.logger.WithError(processingErr).WithFields(fields).Error("Failed to process message")
+
+		// Ошибка из-за недоступной зависимости: сообщение ждёт её восстановления
+		waited, err := c.awaitHealthy(session, message)
+		if err != nil {
+			return nil, nil, err
+		}
+		if waited {
+			outputs, tx, err := c.processMessage(session.Context(), message)
+			if err == nil {
+				return outputs, tx, nil
+			}
+			processingErr = err
+			attempts += errorAttempts(err)
+			continue
+		}
+
+		// Отправляем на следующий уровень повторов или в DLQ, если все попытки исчерпаны
+		if err := c.park(message, processingErr, attempts); err == nil {
+			return nil, nil, nil
+		}
+
+		c.metrics.Unhandled.WithLabelValues(append(c.metrics.labels(message), string(c.failurePolicy))...).Inc()
+
+		switch c.failurePolicy {
+		case FailurePolicySkip:
+			c.logger.WithFields(fields).Warn("Message skipped without dead-lettering")
+			return nil, nil, nil
+
+		case FailurePolicyPause:
+			// Не читаем партицию дальше, пока её не переназначат
+			c.logger.WithFields(fields).Error("Partition paused until rebalance")
+			select {
+			case <-session.Context().Done():
+			case <-c.stopping:
+			}
+			return nil, nil, errPartitionStopped
+
+		case FailurePolicyCrash:
+			err := fmt.Errorf("message %s/%d@%d could not be handled: %w", message.Topic, message.Partition, message.Offset, processingErr)
+			c.crash(err)
+			return nil, nil, err
+
+		default:
+			c.logger.WithFields(fields).Warn("Message blocks partition, retrying")
+			select {
+			case <-session.Context().Done():
+				return nil, nil, errPartitionStopped
+			case <-c.stopping:
+				// Offset не коммитится, сообщение будет обработано после перезапуска
+				return nil, nil, errPartitionStopped
+			case <-time.After(c.config.RetryDelay):
+			}
+
+			outputs, tx, err := c.processMessage(session.Context(), message)
+			if err == nil {
+				return outputs, tx, nil
+			}
+			processingErr = err
+			attempts += errorAttempts(err)
+		}
+	}
+}
+
+// commitMessage публикует выходные сообщения и коммитит offset партиции.
+// next — offset, до которого обработаны все сообщения партиции, или 0, если сообщения
+// до message ещё обрабатываются и offset сдвигать нельзя.
+// В транзакционном режиме выходные сообщения и offset коммитятся в одной транзакции Kafka.
+// В режиме offset store offset сохраняется в транзакции обработчика tx, а если её нет
+// (обработка не удалась) - в отдельной транзакции.
+func (c *Consumer) commitMessage(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage, outputs []*sarama.ProducerMessage, tx *sql.Tx, next int64) error {
+	storeOffset := c.offsets != nil && next > 0
+	if storeOffset && tx == nil {
+		var err error
+		tx, err = c.db.BeginTx(session.Context(), nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+	}
+	if tx != nil {
+		defer tx.Rollback()
 	}
 
+	if storeOffset {
+		if err := c.offsets.store(session.Context(), tx, message.Topic, message.Partition, next); err != nil {
+			return err
+		}
+	}
+
+	if err := c.publishOutputs(session, message, outputs, next); err != nil {
+		return err
+	}
+
+	// Kafka коммитим первой: при сбое коммита PostgreSQL сообщение будет обработано
+	// повторно с того же offset'а, а выходные сообщения продублируются с теми же event_id
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+	}
+
+	// Коммитим offset только после успешной обработки
+	if next > 0 {
+		session.MarkOffset(message.Topic, message.Partition, next, "")
+		c.lag.advance(message.Topic, message.Partition, next)
+	}
+	return nil
+}
+
+// publishOutputs публикует выходные сообщения. В транзакционном режиме они
+// публикуются в транзакции Kafka вместе с offset'ом партиции next.
+func (c *Consumer) publishOutputs(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage, outputs []*sarama.ProducerMessage, next int64) error {
+	if c.txnProducers == nil {
+		if len(outputs) > 0 {
+			if err := c.producer.SendMessages(outputs); err != nil {
+				return fmt.Errorf("failed to publish output messages: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if len(outputs) == 0 && next == 0 {
+		return nil
+	}
+
+	txn, err := c.txnProducers.get(message.Topic, message.Partition)
+	if err != nil {
+		return err
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if err := txn.producer.BeginTxn(); err != nil {
+		return fmt.Errorf("failed to begin kafka transaction: %w", err)
+	}
+
+	for _, output := range outputs {
+		select {
+		case txn.producer.Input() <- output:
+		case <-session.Context().Done():
+			c.abortTxn(txn)
+			return session.Context().Err()
+		}
+	}
+
+	// Offset партиции коммитится вместе с выходными сообщениями
+	if next > 0 {
+		offsets := map[string][]*sarama.PartitionOffsetMetadata{
+			message.Topic: {{Partition: message.Partition, Offset: next}},
+		}
+		if err := txn.producer.AddOffsetsToTxn(offsets, c.config.GroupID); err != nil {
+			c.abortTxn(txn)
+			return fmt.Errorf("failed to add offset to kafka transaction: %w", err)
+		}
+	}
+
+	if err := txn.producer.CommitTxn(); err != nil {
+		c.abortTxn(txn)
+		return fmt.Errorf("failed to commit kafka transaction: %w", err)
+	}
+
+	return nil
+}
+
+// abortTxn прерывает текущую транзакцию Kafka продюсера партиции
+func (c *Consumer) abortTxn(txn *partitionProducer) {
+	if err := txn.producer.AbortTxn(); err != nil {
+		c.logger.WithError(err).Error("Failed to abort kafka transaction")
+	}
+}
+
+// sendToDLQ отправляет сообщение в Dead Letter Queue
+func (c *Consumer) sendToDLQ(originalMessage *sarama.ConsumerMessage, processingError error, attempts int) error {
+	dlqMessage := newDLQMessage(originalMessage, c.config.GroupID, processingError, attempts)
+
 	dlqBytes, err := json.Marshal(dlqMessage)
 	if err != nil {
 		c.logger.WithError(err).Error("Failed to marshal DLQ message")
-		return
+		return fmt.Errorf("failed to marshal DLQ message: %w", err)
 	}
 
 	_, _, err = c.producer.SendMessage(&sarama.ProducerMessage{
@@ -236,23 +658,14 @@ func (c *Consumer) sendToDLQ(originalMessage *sarama.ConsumerMessage, processing
 
 	if err != nil {
 		c.logger.WithError(err).Error("Failed to send message to DLQ")
-	} else {
-		c.metrics.DLQMessages.Inc()
-		c.logger.WithFields(logrus.Fields{
-			"dlq_topic":      c.config.DLQTopic,
-			"original_topic": originalMessage.Topic,
-			"offset":         originalMessage.Offset,
-		}).Warn("Message sent to DLQ")
+		return fmt.Errorf("failed to send message to DLQ: %w", err)
 	}
-}
 
-// DLQMessage представляет сообщение в Dead Letter Queue
-type DLQMessage struct {
-	OriginalTopic     string    `json:"original_topic"`
-	OriginalPartition int32     `json:"original_partition"`
-	OriginalOffset    int64     `json:"original_offset"`
-	OriginalKey       string    `json:"original_key"`
-	OriginalValue     string    `json:"original_value"`
-	Error             string    `json:"error"`
-	Timestamp         time.Time `json:"timestamp"`
+	c.metrics.DLQMessages.WithLabelValues(c.metrics.labels(originalMessage)...).Inc()
+	c.logger.WithFields(logrus.Fields{
+		"dlq_topic":      c.config.DLQTopic,
+		"original_topic": originalMessage.Topic,
+		"offset":         originalMessage.Offset,
+	}).Warn("Message sent to DLQ")
+	return nil
 }
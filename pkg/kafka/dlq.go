@@ -0,0 +1,402 @@
+package kafka
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Shopify/sarama"
+)
+
+// DLQSchemaVersion — текущая версия схемы DLQMessage.
+// Версия 1 (без поля schema_version) хранила ключ и значение строками, без заголовков.
+const DLQSchemaVersion = 2
+
+// Кодировки ключа и значения исходного сообщения в DLQMessage
+const (
+	DLQEncodingText   = "text"   // UTF-8 строка как есть
+	DLQEncodingBase64 = "base64" // Бинарные данные в base64
+)
+
+// DLQMessage представляет сообщение в Dead Letter Queue
+type DLQMessage struct {
+	SchemaVersion     int         `json:"schema_version,omitempty"`
+	OriginalTopic     string      `json:"original_topic"`
+	OriginalPartition int32       `json:"original_partition"`
+	OriginalOffset    int64       `json:"original_offset"`
+	OriginalKey       string      `json:"original_key"`
+	OriginalValue     string      `json:"original_value"`
+	Encoding          string      `json:"encoding,omitempty"` // Кодировка OriginalKey и OriginalValue
+	OriginalHeaders   []DLQHeader `json:"original_headers,omitempty"`
+	OriginalTimestamp time.Time   `json:"original_timestamp,omitempty"`
+	ConsumerGroup     string      `json:"consumer_group,omitempty"`
+	Attempts          int         `json:"attempts,omitempty"`
+	Error             string      `json:"error"`
+	ErrorChain        []string    `json:"error_chain,omitempty"` // Ошибка и все обёрнутые ею ошибки
+	Host              string      `json:"host,omitempty"`
+	Timestamp         time.Time   `json:"timestamp"`
+}
+
+// DLQHeader — заголовок исходного сообщения, значение хранится в base64
+type DLQHeader struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// newDLQMessage собирает запись DLQ для сообщения, которое не удалось обработать
+func newDLQMessage(message *sarama.ConsumerMessage, groupID string, processingErr error, attempts int) *DLQMessage {
+	// Ключ и значение кодируются вместе, чтобы читателю хватило одного поля Encoding
+	encoding := DLQEncodingText
+	if !utf8.Valid(message.Key) || !utf8.Valid(message.Value) {
+		encoding = DLQEncodingBase64
+	}
+
+	headers := make([]DLQHeader, 0, len(message.Headers))
+	for _, header := range message.Headers {
+		if header != nil {
+			headers = append(headers, DLQHeader{Key: string(header.Key), Value: header.Value})
+		}
+	}
+
+	host, _ := os.Hostname()
+	partition, offset := originalPosition(message)
+
+	return &DLQMessage{
+		SchemaVersion:     DLQSchemaVersion,
+		OriginalTopic:     originalTopic(message),
+		OriginalPartition: partition,
+		OriginalOffset:    offset,
+		OriginalKey:       encodeDLQData(message.Key, encoding),
+		OriginalValue:     encodeDLQData(message.Value, encoding),
+		Encoding:          encoding,
+		OriginalHeaders:   headers,
+		OriginalTimestamp: message.Timestamp,
+		ConsumerGroup:     groupID,
+		Attempts:          attempts,
+		Error:             processingErr.Error(),
+		ErrorChain:        errorChain(processingErr),
+		Host:              host,
+		Timestamp:         time.Now(),
+	}
+}
+
+// encodeDLQData кодирует ключ или значение сообщения
+func encodeDLQData(data []byte, encoding string) string {
+	if encoding == DLQEncodingBase64 {
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	return string(data)
+}
+
+// decodeDLQData декодирует ключ или значение сообщения
+func (m *DLQMessage) decodeDLQData(data string) ([]byte, error) {
+	switch m.Encoding {
+	case "", DLQEncodingText:
+		return []byte(data), nil
+	case DLQEncodingBase64:
+		return base64.StdEncoding.DecodeString(data)
+	default:
+		return nil, fmt.Errorf("unknown DLQ encoding %q", m.Encoding)
+	}
+}
+
+// Key возвращает ключ исходного сообщения
+func (m *DLQMessage) Key() ([]byte, error) {
+	return m.decodeDLQData(m.OriginalKey)
+}
+
+// Value возвращает значение исходного сообщения
+func (m *DLQMessage) Value() ([]byte, error) {
+	return m.decodeDLQData(m.OriginalValue)
+}
+
+// Version возвращает версию схемы записи с учётом записей версии 1 без поля schema_version
+func (m *DLQMessage) Version() int {
+	if m.SchemaVersion == 0 {
+		return 1
+	}
+	return m.SchemaVersion
+}
+
+// ReplayedFromDLQHeader — заголовок сообщения, переотправленного из DLQ. Значение -
+// позиция записи в DLQ в формате topic/partition/offset.
+const ReplayedFromDLQHeader = "replayed-from-dlq"
+
+// DLQEntry — запись DLQ вместе с её позицией в топике DLQ
+type DLQEntry struct {
+	Topic     string       `json:"dlq_topic"`
+	Partition int32        `json:"dlq_partition"`
+	Offset    int64        `json:"dlq_offset"`
+	Message   DLQMessage   `json:"message"`
+	Event     *PolicyEvent `json:"event,omitempty"` // Разобранный payload, если это PolicyEvent
+
+	payload []byte
+}
+
+// Position возвращает позицию записи в формате topic/partition/offset
+func (e *DLQEntry) Position() string {
+	return fmt.Sprintf("%s/%d/%d", e.Topic, e.Partition, e.Offset)
+}
+
+// Payload возвращает декодированное исходное значение сообщения
+func (e *DLQEntry) Payload() []byte {
+	return e.payload
+}
+
+// DLQFilter отбирает записи DLQ. Пустые поля не участвуют в отборе.
+type DLQFilter struct {
+	ErrorContains string
+	EventType     string
+	PolicyID      string
+	Since         time.Time
+	Until         time.Time
+}
+
+// Match проверяет, что запись подходит под фильтр
+func (f *DLQFilter) Match(entry *DLQEntry) bool {
+	if f.ErrorContains != "" && !strings.Contains(entry.Message.Error, f.ErrorContains) {
+		return false
+	}
+	if f.EventType != "" && (entry.Event == nil || entry.Event.EventType != f.EventType) {
+		return false
+	}
+	if f.PolicyID != "" && (entry.Event == nil || entry.Event.PolicyID != f.PolicyID) {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Message.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && entry.Message.Timestamp.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// ReadDLQ читает из топика DLQ все записи, которые были в нём на момент вызова
+func ReadDLQ(ctx context.Context, brokers []string, topic string) ([]*DLQEntry, error) {
+	cfg := DefaultConfig()
+	cfg.Brokers = brokers
+	return ReadDLQFromConfig(ctx, cfg, topic)
+}
+
+// ReadDLQFromConfig читает DLQ с подключением по конфигурации, в том числе TLS и SASL
+func ReadDLQFromConfig(ctx context.Context, cfg *Config, topic string) ([]*DLQEntry, error) {
+	consumerConfig, err := cfg.ConsumerConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := sarama.NewClient(cfg.Brokers, consumerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kafka client: %w", err)
+	}
+	defer client.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer: %w", err)
+	}
+	defer consumer.Close()
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get partitions of %s: %w", topic, err)
+	}
+
+	var entries []*DLQEntry
+	for _, partition := range partitions {
+		partitionEntries, err := readDLQPartition(ctx, client, consumer, topic, partition)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, partitionEntries...)
+	}
+
+	return entries, nil
+}
+
+// dlqReadIdleTimeout — сколько readDLQPartition ждёт следующей записи, прежде чем считать
+// партицию прочитанной. Последние offset'ы партиции могут занимать маркеры транзакций
+// и отменённые записи, которые консьюмер не получает.
+const dlqReadIdleTimeout = time.Second * 2
+
+// readDLQPartition читает партицию DLQ до offset'а, актуального на момент вызова: до последней
+// записи перед ним или, если записи в конце партиции не доставляются, до паузы dlqReadIdleTimeout
+func readDLQPartition(ctx context.Context, client sarama.Client, consumer sarama.Consumer, topic string, partition int32) ([]*DLQEntry, error) {
+	newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get newest offset of %s/%d: %w", topic, partition, err)
+	}
+	oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get oldest offset of %s/%d: %w", topic, partition, err)
+	}
+	if oldest >= newest {
+		return nil, nil
+	}
+
+	partitionConsumer, err := consumer.ConsumePartition(topic, partition, oldest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume %s/%d: %w", topic, partition, err)
+	}
+	defer partitionConsumer.Close()
+
+	idle := time.NewTimer(dlqReadIdleTimeout)
+	defer idle.Stop()
+
+	var entries []*DLQEntry
+	for {
+		select {
+		case message := <-partitionConsumer.Messages():
+			stopTimer(idle)
+			idle.Reset(dlqReadIdleTimeout)
+
+			entry := &DLQEntry{
+				Topic:     message.Topic,
+				Partition: message.Partition,
+				Offset:    message.Offset,
+			}
+			if err := json.Unmarshal(message.Value, &entry.Message); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal DLQ message %s: %w", entry.Position(), err)
+			}
+			if version := entry.Message.Version(); version > DLQSchemaVersion {
+				return nil, fmt.Errorf("DLQ message %s has unsupported schema version %d", entry.Position(), version)
+			}
+			if entry.payload, err = entry.Message.Value(); err != nil {
+				return nil, fmt.Errorf("failed to decode DLQ message %s: %w", entry.Position(), err)
+			}
+
+			// Payload может быть не PolicyEvent - тогда фильтры по событию его не выберут
+			var event PolicyEvent
+			if err := json.Unmarshal(entry.Payload(), &event); err == nil {
+				entry.Event = &event
+			}
+
+			entries = append(entries, entry)
+			if message.Offset >= newest-1 {
+				return entries, nil
+			}
+
+		case <-idle.C:
+			// Записей до newest больше нет: остались маркеры транзакций или отменённые записи
+			return entries, nil
+
+		case err := <-partitionConsumer.Errors():
+			return nil, fmt.Errorf("failed to read %s/%d: %w", topic, partition, err)
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// ReplayDLQEntry публикует запись DLQ с заголовком replayed-from-dlq. Если задан retryTopic
+// (первый уровень повторов исходного топика), запись публикуется в него с заголовком
+// retry-consumer-group: её повторно обработает только консьюмер-группа, которая не смогла
+// её обработать. С пустым retryTopic запись публикуется в исходный топик, и её обработают
+// все группы. payload заменяет исходное значение сообщения, если не nil.
+func ReplayDLQEntry(producer sarama.SyncProducer, entry *DLQEntry, payload []byte, retryTopic string) (*DeliveryResult, error) {
+	if payload == nil {
+		payload = entry.Payload()
+	}
+	if retryTopic != "" && entry.Message.ConsumerGroup == "" {
+		return nil, fmt.Errorf("DLQ message %s has no consumer group, it can only be replayed to all groups", entry.Position())
+	}
+
+	key, err := entry.Message.Key()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key of %s: %w", entry.Position(), err)
+	}
+
+	// Заголовки повторов относятся к прошлой доставке и не переносятся
+	headers := []sarama.RecordHeader{
+		{Key: []byte(ReplayedFromDLQHeader), Value: []byte(entry.Position())},
+	}
+	for _, header := range entry.Message.OriginalHeaders {
+		switch header.Key {
+		case ReplayedFromDLQHeader, retryAfterHeader, retryTopicHeader, retryPartitionHeader, retryOffsetHeader, retryGroupHeader, retryErrorHeader, retryAttemptHeader:
+			continue
+		}
+		headers = append(headers, sarama.RecordHeader{Key: []byte(header.Key), Value: header.Value})
+	}
+
+	// В записях версии 1 заголовков нет: event_id нужен DedupMiddleware, берём его из события
+	var event PolicyEvent
+	if entry.Message.Version() == 1 && json.Unmarshal(payload, &event) == nil && event.ID != "" {
+		headers = append(headers,
+			sarama.RecordHeader{Key: []byte(eventIDHeader), Value: []byte(event.ID)},
+			sarama.RecordHeader{Key: []byte("event_type"), Value: []byte(event.EventType)},
+			sarama.RecordHeader{Key: []byte("source"), Value: []byte(event.Source)},
+		)
+	}
+
+	topic := entry.Message.OriginalTopic
+	if retryTopic != "" {
+		// Повтор созревает сразу и пропускается остальными группами, см. isForeignRetry
+		topic = retryTopic
+		headers = append(headers,
+			sarama.RecordHeader{Key: []byte(retryAfterHeader), Value: []byte(time.Now().Format(time.RFC3339Nano))},
+			sarama.RecordHeader{Key: []byte(retryTopicHeader), Value: []byte(entry.Message.OriginalTopic)},
+			sarama.RecordHeader{Key: []byte(retryPartitionHeader), Value: []byte(strconv.Itoa(int(entry.Message.OriginalPartition)))},
+			sarama.RecordHeader{Key: []byte(retryOffsetHeader), Value: []byte(strconv.FormatInt(entry.Message.OriginalOffset, 10))},
+			sarama.RecordHeader{Key: []byte(retryGroupHeader), Value: []byte(entry.Message.ConsumerGroup)},
+		)
+	}
+
+	message := &sarama.ProducerMessage{
+		Topic:     topic,
+		Key:       sarama.ByteEncoder(key),
+		Value:     sarama.ByteEncoder(payload),
+		Headers:   headers,
+		Timestamp: entry.Message.OriginalTimestamp,
+	}
+
+	partition, offset, err := producer.SendMessage(message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to replay %s: %w", entry.Position(), err)
+	}
+
+	return &DeliveryResult{Topic: message.Topic, Partition: partition, Offset: offset}, nil
+}
+
+// MergePatch применяет к JSON документу patch по правилам JSON Merge Patch (RFC 7386):
+// поля patch заменяют поля документа, null удаляет поле, объекты сливаются рекурсивно
+func MergePatch(document, patch []byte) ([]byte, error) {
+	var target, changes interface{}
+	if err := json.Unmarshal(document, &target); err != nil {
+		return nil, fmt.Errorf("failed to parse document: %w", err)
+	}
+	if err := json.Unmarshal(patch, &changes); err != nil {
+		return nil, fmt.Errorf("failed to parse patch: %w", err)
+	}
+
+	return json.Marshal(mergePatchValue(target, changes))
+}
+
+// mergePatchValue рекурсивно применяет patch к значению target
+func mergePatchValue(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = mergePatchValue(targetObject[key], value)
+	}
+
+	return targetObject
+}
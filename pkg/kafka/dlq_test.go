@@ -0,0 +1,308 @@
+package kafka
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+// recordingProducer запоминает отправленное сообщение вместо публикации
+type recordingProducer struct {
+	sarama.SyncProducer
+	sent *sarama.ProducerMessage
+}
+
+func (p *recordingProducer) SendMessage(message *sarama.ProducerMessage) (int32, int64, error) {
+	p.sent = message
+	return 0, 42, nil
+}
+
+// headerMap собирает заголовки сообщения, повторяющийся ключ считается ошибкой теста
+func headerMap(t *testing.T, headers []sarama.RecordHeader) map[string]string {
+	t.Helper()
+	values := make(map[string]string, len(headers))
+	for _, header := range headers {
+		if _, ok := values[string(header.Key)]; ok {
+			t.Errorf("header %q is set twice", header.Key)
+		}
+		values[string(header.Key)] = string(header.Value)
+	}
+	return values
+}
+
+func TestDLQMessageDecode(t *testing.T) {
+	binary := []byte{0xff, 0x00, 0xfe}
+
+	tests := []struct {
+		name        string
+		raw         string // Запись DLQ в JSON
+		wantVersion int
+		wantKey     []byte
+		wantValue   []byte
+		wantErr     bool
+	}{
+		{
+			name:        "v1 without encoding",
+			raw:         `{"original_topic":"auto.events","original_key":"policy-1","original_value":"{\"id\":\"1\"}","error":"boom"}`,
+			wantVersion: 1,
+			wantKey:     []byte("policy-1"),
+			wantValue:   []byte(`{"id":"1"}`),
+		},
+		{
+			name:        "v2 text",
+			raw:         `{"schema_version":2,"original_key":"policy-1","original_value":"{}","encoding":"text","error":"boom"}`,
+			wantVersion: 2,
+			wantKey:     []byte("policy-1"),
+			wantValue:   []byte("{}"),
+		},
+		{
+			name:        "v2 base64",
+			raw:         `{"schema_version":2,"original_key":"a2V5","original_value":"` + base64.StdEncoding.EncodeToString(binary) + `","encoding":"base64","error":"boom"}`,
+			wantVersion: 2,
+			wantKey:     []byte("key"),
+			wantValue:   binary,
+		},
+		{
+			name:        "unknown encoding",
+			raw:         `{"schema_version":2,"original_key":"k","original_value":"v","encoding":"gzip","error":"boom"}`,
+			wantVersion: 2,
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var message DLQMessage
+			if err := json.Unmarshal([]byte(tt.raw), &message); err != nil {
+				t.Fatalf("unmarshal DLQ message: %v", err)
+			}
+
+			if got := message.Version(); got != tt.wantVersion {
+				t.Errorf("Version() = %d, want %d", got, tt.wantVersion)
+			}
+
+			key, err := message.Key()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Key() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			value, err := message.Value()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Value() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if string(key) != string(tt.wantKey) {
+				t.Errorf("Key() = %q, want %q", key, tt.wantKey)
+			}
+			if string(value) != string(tt.wantValue) {
+				t.Errorf("Value() = %q, want %q", value, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestNewDLQMessage(t *testing.T) {
+	tests := []struct {
+		name          string
+		message       *sarama.ConsumerMessage
+		wantEncoding  string
+		wantTopic     string
+		wantPartition int32
+		wantOffset    int64
+	}{
+		{
+			name:          "text message",
+			message:       &sarama.ConsumerMessage{Topic: "auto.events", Partition: 1, Offset: 10, Key: []byte("policy-1"), Value: []byte(`{"id":"1"}`)},
+			wantEncoding:  DLQEncodingText,
+			wantTopic:     "auto.events",
+			wantPartition: 1,
+			wantOffset:    10,
+		},
+		{
+			name:         "binary value",
+			message:      &sarama.ConsumerMessage{Topic: "auto.events", Key: []byte("policy-1"), Value: []byte{0xff, 0xfe}},
+			wantEncoding: DLQEncodingBase64,
+			wantTopic:    "auto.events",
+		},
+		{
+			name:         "binary key",
+			message:      &sarama.ConsumerMessage{Topic: "auto.events", Key: []byte{0xc3}, Value: []byte("{}")},
+			wantEncoding: DLQEncodingBase64,
+			wantTopic:    "auto.events",
+		},
+		{
+			name: "message from retry topic",
+			message: &sarama.ConsumerMessage{
+				Topic:     "auto.events.retry.1",
+				Partition: 0,
+				Offset:    3,
+				Value:     []byte("{}"),
+				Headers: []*sarama.RecordHeader{
+					{Key: []byte(retryTopicHeader), Value: []byte("auto.events")},
+					{Key: []byte(retryPartitionHeader), Value: []byte("2")},
+					{Key: []byte(retryOffsetHeader), Value: []byte("77")},
+				},
+			},
+			wantEncoding:  DLQEncodingText,
+			wantTopic:     "auto.events",
+			wantPartition: 2,
+			wantOffset:    77,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dlqMessage := newDLQMessage(tt.message, "billing-service", errors.New("boom"), 3)
+
+			if dlqMessage.Encoding != tt.wantEncoding {
+				t.Errorf("Encoding = %q, want %q", dlqMessage.Encoding, tt.wantEncoding)
+			}
+			if dlqMessage.OriginalTopic != tt.wantTopic || dlqMessage.OriginalPartition != tt.wantPartition || dlqMessage.OriginalOffset != tt.wantOffset {
+				t.Errorf("original position = %s/%d/%d, want %s/%d/%d",
+					dlqMessage.OriginalTopic, dlqMessage.OriginalPartition, dlqMessage.OriginalOffset,
+					tt.wantTopic, tt.wantPartition, tt.wantOffset)
+			}
+
+			// Запись читается обратно без потерь
+			raw, err := json.Marshal(dlqMessage)
+			if err != nil {
+				t.Fatalf("marshal DLQ message: %v", err)
+			}
+			var decoded DLQMessage
+			if err := json.Unmarshal(raw, &decoded); err != nil {
+				t.Fatalf("unmarshal DLQ message: %v", err)
+			}
+			if decoded.Version() != DLQSchemaVersion {
+				t.Errorf("Version() = %d, want %d", decoded.Version(), DLQSchemaVersion)
+			}
+			key, err := decoded.Key()
+			if err != nil || string(key) != string(tt.message.Key) {
+				t.Errorf("Key() = %q, %v, want %q", key, err, tt.message.Key)
+			}
+			value, err := decoded.Value()
+			if err != nil || string(value) != string(tt.message.Value) {
+				t.Errorf("Value() = %q, %v, want %q", value, err, tt.message.Value)
+			}
+		})
+	}
+}
+
+func TestReplayDLQEntry(t *testing.T) {
+	payload := []byte(`{"id":"event-1","policy_id":"policy-1","event_type":"created","source":"policy-service"}`)
+	retryHeaders := []DLQHeader{
+		{Key: "trace_id", Value: []byte("trace-1")},
+		{Key: retryAfterHeader, Value: []byte("2024-01-01T00:00:00Z")},
+		{Key: retryTopicHeader, Value: []byte("auto.events")},
+		{Key: retryPartitionHeader, Value: []byte("0")},
+		{Key: retryOffsetHeader, Value: []byte("1")},
+		{Key: retryGroupHeader, Value: []byte("other-group")},
+		{Key: retryErrorHeader, Value: []byte("boom")},
+		{Key: retryAttemptHeader, Value: []byte("2")},
+		{Key: ReplayedFromDLQHeader, Value: []byte("auto.events.dlq/0/1")},
+	}
+
+	tests := []struct {
+		name          string
+		message       DLQMessage
+		retryTopic    string
+		wantTopic     string
+		wantHeaders   map[string]string // Заголовки, которые должны быть у сообщения
+		absentHeaders []string          // Заголовки, которых быть не должно
+		wantErr       bool
+	}{
+		{
+			name: "retry headers are dropped",
+			message: DLQMessage{
+				SchemaVersion:   DLQSchemaVersion,
+				OriginalTopic:   "auto.events",
+				OriginalHeaders: retryHeaders,
+				ConsumerGroup:   "billing-service",
+			},
+			wantTopic: "auto.events",
+			wantHeaders: map[string]string{
+				"trace_id":            "trace-1",
+				ReplayedFromDLQHeader: "auto.events.dlq/1/5",
+			},
+			absentHeaders: []string{retryAfterHeader, retryTopicHeader, retryGroupHeader, retryErrorHeader, retryAttemptHeader, eventIDHeader},
+		},
+		{
+			name:      "v1 entry gets event headers from payload",
+			message:   DLQMessage{OriginalTopic: "auto.events"},
+			wantTopic: "auto.events",
+			wantHeaders: map[string]string{
+				eventIDHeader:         "event-1",
+				"event_type":          "created",
+				"source":              "policy-service",
+				ReplayedFromDLQHeader: "auto.events.dlq/1/5",
+			},
+		},
+		{
+			name: "replay to retry topic of the failed group",
+			message: DLQMessage{
+				SchemaVersion:     DLQSchemaVersion,
+				OriginalTopic:     "auto.events",
+				OriginalPartition: 2,
+				OriginalOffset:    77,
+				OriginalHeaders:   retryHeaders,
+				ConsumerGroup:     "billing-service",
+			},
+			retryTopic: "auto.events.retry.1",
+			wantTopic:  "auto.events.retry.1",
+			wantHeaders: map[string]string{
+				retryTopicHeader:     "auto.events",
+				retryPartitionHeader: "2",
+				retryOffsetHeader:    "77",
+				retryGroupHeader:     "billing-service",
+			},
+			absentHeaders: []string{retryErrorHeader, retryAttemptHeader},
+		},
+		{
+			name:       "retry topic without consumer group",
+			message:    DLQMessage{SchemaVersion: DLQSchemaVersion, OriginalTopic: "auto.events"},
+			retryTopic: "auto.events.retry.1",
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &DLQEntry{Topic: "auto.events.dlq", Partition: 1, Offset: 5, Message: tt.message, payload: payload}
+			producer := &recordingProducer{}
+
+			result, err := ReplayDLQEntry(producer, entry, nil, tt.retryTopic)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("ReplayDLQEntry() expected error")
+				}
+				if producer.sent != nil {
+					t.Error("message was sent despite error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReplayDLQEntry() error = %v", err)
+			}
+
+			if result.Topic != tt.wantTopic || producer.sent.Topic != tt.wantTopic {
+				t.Errorf("topic = %s, want %s", producer.sent.Topic, tt.wantTopic)
+			}
+
+			headers := headerMap(t, producer.sent.Headers)
+			for key, want := range tt.wantHeaders {
+				if got, ok := headers[key]; !ok || got != want {
+					t.Errorf("header %s = %q, want %q", key, got, want)
+				}
+			}
+			for _, key := range tt.absentHeaders {
+				if _, ok := headers[key]; ok {
+					t.Errorf("header %s must not be replayed", key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Shopify/sarama"
+)
+
+// ErrNoEmitter возвращается Emit, если обработчик вызван вне консьюмера
+var ErrNoEmitter = errors.New("kafka: no output emitter in context")
+
+// outputBufferKey — ключ контекста для буфера выходных сообщений
+type outputBufferKey struct{}
+
+// outputBuffer накапливает сообщения, которые обработчик публикует по результатам обработки
+type outputBuffer struct {
+	messages []*sarama.ProducerMessage
+}
+
+// withOutputBuffer добавляет в контекст пустой буфер выходных сообщений
+func withOutputBuffer(ctx context.Context) (context.Context, *outputBuffer) {
+	buffer := &outputBuffer{}
+	return context.WithValue(ctx, outputBufferKey{}, buffer), buffer
+}
+
+// reset очищает буфер перед очередной попыткой обработки
+func (b *outputBuffer) reset() {
+	b.messages = nil
+}
+
+// Emit ставит выходное сообщение в очередь на публикацию.
+// Сообщения публикуются только если обработка завершилась успешно; в транзакционном
+// режиме консьюмера - в одной транзакции Kafka с коммитом offset'а входного сообщения.
+func Emit(ctx context.Context, message *sarama.ProducerMessage) error {
+	buffer, ok := ctx.Value(outputBufferKey{}).(*outputBuffer)
+	if !ok {
+		return ErrNoEmitter
+	}
+
+	buffer.messages = append(buffer.messages, message)
+	return nil
+}
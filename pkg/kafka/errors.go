@@ -0,0 +1,115 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Классы ошибок обработчика, проверяются через errors.Is
+var (
+	// ErrPermanent — ошибка, которая не исчезнет при повторе (битое сообщение, нарушение инварианта)
+	ErrPermanent = errors.New("kafka: permanent error")
+	// ErrTransient — временная ошибка (сеть, блокировка в базе), обработку стоит повторить
+	ErrTransient = errors.New("kafka: transient error")
+	// ErrTimeout — попытка обработки не уложилась в Config.ProcessingTimeout; такая ошибка
+	// считается временной
+	ErrTimeout = errors.New("kafka: processing timeout")
+)
+
+// classifiedError помечает ошибку обработчика классом ErrPermanent или ErrTransient
+type classifiedError struct {
+	err   error
+	class error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// Is сопоставляет ошибку с её классом
+func (e *classifiedError) Is(target error) bool {
+	return target == e.class
+}
+
+// Permanent помечает ошибку как постоянную: сообщение сразу уходит в DLQ без повторов
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{err: err, class: ErrPermanent}
+}
+
+// Transient помечает ошибку как временную: обработка будет повторена
+func Transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{err: err, class: ErrTransient}
+}
+
+// timeoutError — ошибка попытки, прерванной по таймауту обработки
+type timeoutError struct {
+	err     error
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("processing timed out after %s: %v", e.timeout, e.err)
+}
+
+func (e *timeoutError) Unwrap() error {
+	return e.err
+}
+
+// Is сопоставляет ошибку с классами ErrTimeout и ErrTransient
+func (e *timeoutError) Is(target error) bool {
+	return target == ErrTimeout || target == ErrTransient
+}
+
+// attemptsError — ошибка обработки сообщения с числом попыток, сделанных консьюмером
+type attemptsError struct {
+	err      error
+	attempts int
+}
+
+func (e *attemptsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *attemptsError) Unwrap() error {
+	return e.err
+}
+
+// errorAttempts возвращает число попыток обработки, за которое получена ошибка
+func errorAttempts(err error) int {
+	var attemptsErr *attemptsError
+	if errors.As(err, &attemptsErr) {
+		return attemptsErr.attempts
+	}
+	return 1
+}
+
+// errorChain возвращает тексты ошибки и всех ошибок, которые она оборачивает
+func errorChain(err error) []string {
+	var chain []string
+	for err != nil {
+		chain = append(chain, err.Error())
+		err = errors.Unwrap(err)
+	}
+	return chain
+}
+
+// IsPermanent проверяет, что ошибка помечена как постоянная
+func IsPermanent(err error) bool {
+	return errors.Is(err, ErrPermanent)
+}
+
+// IsTimeout проверяет, что попытка обработки прервана по таймауту
+func IsTimeout(err error) bool {
+	return errors.Is(err, ErrTimeout)
+}
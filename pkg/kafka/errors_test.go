@@ -0,0 +1,127 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestErrorClassification(t *testing.T) {
+	base := errors.New("boom")
+
+	tests := []struct {
+		name          string
+		err           error
+		wantPermanent bool
+		wantTransient bool
+		wantTimeout   bool
+		wantRetryable bool
+	}{
+		{name: "plain error", err: base, wantRetryable: true},
+		{name: "permanent", err: Permanent(base), wantPermanent: true},
+		{name: "wrapped permanent", err: fmt.Errorf("handler: %w", Permanent(base)), wantPermanent: true},
+		{name: "transient", err: Transient(base), wantTransient: true, wantRetryable: true},
+		{name: "wrapped transient", err: fmt.Errorf("handler: %w", Transient(base)), wantTransient: true, wantRetryable: true},
+		{
+			name:          "timeout",
+			err:           &timeoutError{err: context.DeadlineExceeded, timeout: time.Second},
+			wantTransient: true,
+			wantTimeout:   true,
+			wantRetryable: true,
+		},
+		{name: "context canceled", err: context.Canceled},
+		{name: "context deadline", err: fmt.Errorf("query: %w", context.DeadlineExceeded)},
+		{name: "transient context canceled", err: Transient(context.Canceled), wantTransient: true, wantRetryable: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsPermanent(tt.err); got != tt.wantPermanent {
+				t.Errorf("IsPermanent() = %v, want %v", got, tt.wantPermanent)
+			}
+			if got := errors.Is(tt.err, ErrTransient); got != tt.wantTransient {
+				t.Errorf("errors.Is(ErrTransient) = %v, want %v", got, tt.wantTransient)
+			}
+			if got := IsTimeout(tt.err); got != tt.wantTimeout {
+				t.Errorf("IsTimeout() = %v, want %v", got, tt.wantTimeout)
+			}
+			if got := isRetryableError(tt.err); got != tt.wantRetryable {
+				t.Errorf("isRetryableError() = %v, want %v", got, tt.wantRetryable)
+			}
+		})
+	}
+}
+
+func TestClassifiedErrorKeepsCause(t *testing.T) {
+	base := errors.New("boom")
+
+	for _, err := range []error{Permanent(base), Transient(base)} {
+		if !errors.Is(err, base) {
+			t.Errorf("%T does not unwrap to its cause", err)
+		}
+		if err.Error() != base.Error() {
+			t.Errorf("Error() = %q, want %q", err.Error(), base.Error())
+		}
+	}
+
+	if Permanent(nil) != nil || Transient(nil) != nil {
+		t.Error("classifying nil must return nil")
+	}
+}
+
+func TestErrorAttempts(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "plain error", err: errors.New("boom"), want: 1},
+		{name: "attempts error", err: &attemptsError{err: errors.New("boom"), attempts: 4}, want: 4},
+		{name: "wrapped attempts error", err: fmt.Errorf("batch: %w", &attemptsError{err: errors.New("boom"), attempts: 2}), want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorAttempts(tt.err); got != tt.want {
+				t.Errorf("errorAttempts() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{
+		InitialDelay: time.Second,
+		MaxDelay:     time.Second * 10,
+		Multiplier:   2,
+	}
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 1, want: time.Second},
+		{attempt: 2, want: time.Second * 2},
+		{attempt: 3, want: time.Second * 4},
+		{attempt: 4, want: time.Second * 8},
+		{attempt: 5, want: time.Second * 10},
+		{attempt: 10, want: time.Second * 10},
+	}
+
+	for _, tt := range tests {
+		if got := policy.Delay(tt.attempt); got != tt.want {
+			t.Errorf("Delay(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+
+	// Разброс остаётся в пределах ±Jitter от задержки без него
+	policy.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		got := policy.Delay(2)
+		if got < time.Millisecond*1600 || got > time.Millisecond*2400 {
+			t.Fatalf("Delay(2) with jitter = %s, want within [1.6s, 2.4s]", got)
+		}
+	}
+}
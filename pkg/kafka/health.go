@@ -0,0 +1,298 @@
+package kafka
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+)
+
+// Причины приостановки консьюмера
+const (
+	// PauseReasonManual — консьюмер приостановлен через Pause
+	PauseReasonManual = "manual"
+	// PauseReasonHealth — недоступна зависимость, см. HealthChecker
+	PauseReasonHealth = "health"
+)
+
+// HealthChecker проверяет доступность зависимости обработчиков
+type HealthChecker interface {
+	Check(ctx context.Context) error
+}
+
+// HealthCheckFunc позволяет использовать функцию как HealthChecker
+type HealthCheckFunc func(ctx context.Context) error
+
+// Check вызывает функцию
+func (f HealthCheckFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// DBHealthChecker проверяет доступность PostgreSQL
+type DBHealthChecker struct {
+	db *sql.DB
+}
+
+// NewDBHealthChecker создаёт проверку базы данных
+func NewDBHealthChecker(db *sql.DB) *DBHealthChecker {
+	return &DBHealthChecker{db: db}
+}
+
+// Check проверяет соединение с базой данных
+func (h *DBHealthChecker) Check(ctx context.Context) error {
+	return h.db.PingContext(ctx)
+}
+
+// namedChecker — проверка зависимости с именем для логов
+type namedChecker struct {
+	name    string
+	checker HealthChecker
+}
+
+// pauseState хранит причины приостановки консьюмера. Консьюмер приостановлен,
+// пока есть хотя бы одна причина.
+type pauseState struct {
+	mu      sync.Mutex
+	reasons map[string]bool
+	resumed chan struct{} // Закрыт, пока консьюмер не приостановлен
+}
+
+// newPauseState создаёт состояние неприостановленного консьюмера
+func newPauseState() *pauseState {
+	resumed := make(chan struct{})
+	close(resumed)
+	return &pauseState{
+		reasons: make(map[string]bool),
+		resumed: resumed,
+	}
+}
+
+// set добавляет или снимает причину и сообщает, изменилось ли состояние консьюмера
+func (p *pauseState) set(reason string, paused bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	was := len(p.reasons) > 0
+	if paused {
+		p.reasons[reason] = true
+	} else {
+		delete(p.reasons, reason)
+	}
+	now := len(p.reasons) > 0
+
+	switch {
+	case !was && now:
+		p.resumed = make(chan struct{})
+	case was && !now:
+		close(p.resumed)
+	}
+	return was != now
+}
+
+// has сообщает, приостановлен ли консьюмер по причине
+func (p *pauseState) has(reason string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.reasons[reason]
+}
+
+// wait возвращает канал, который закрыт, пока консьюмер не приостановлен
+func (p *pauseState) wait() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.resumed
+}
+
+// list возвращает причины приостановки
+func (p *pauseState) list() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	reasons := make([]string, 0, len(p.reasons))
+	for reason := range p.reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+// AddHealthChecker добавляет проверку зависимости. Пока проверка не проходит, консьюмер
+// приостановлен: сообщения ждут в Kafka, а не уходят в топики повторов и DLQ.
+// Проверка PostgreSQL добавляется в NewConsumer автоматически.
+func (c *Consumer) AddHealthChecker(name string, checker HealthChecker) {
+	c.checkers = append(c.checkers, namedChecker{name: name, checker: checker})
+}
+
+// Pause приостанавливает чтение и обработку всех партиций до вызова Resume.
+// Сообщения, которые уже обрабатываются, завершаются.
+func (c *Consumer) Pause() {
+	c.setPaused(PauseReasonManual, true)
+}
+
+// Resume снимает приостановку, заданную Pause. Если недоступна зависимость,
+// консьюмер возобновится после её восстановления.
+func (c *Consumer) Resume() {
+	c.setPaused(PauseReasonManual, false)
+}
+
+// PauseReasons возвращает причины, по которым консьюмер приостановлен, пусто - работает
+func (c *Consumer) PauseReasons() []string {
+	return c.pauses.list()
+}
+
+// setPaused добавляет или снимает причину приостановки и останавливает
+// или возобновляет чтение партиций
+func (c *Consumer) setPaused(reason string, paused bool) {
+	changed := c.pauses.set(reason, paused)
+
+	value := 0.0
+	if paused {
+		value = 1
+	}
+	c.metrics.Paused.WithLabelValues(c.config.GroupID, reason).Set(value)
+
+	if !changed {
+		return
+	}
+
+	c.runMu.Lock()
+	run := c.run
+	c.runMu.Unlock()
+
+	// PauseAll действует на партиции, которые читаются сейчас; партиции следующих сессий
+	// приостанавливает pauseClaim
+	if paused {
+		c.logger.WithField("reason", reason).Warn("Consumer paused")
+		if run != nil {
+			run.group.PauseAll()
+		}
+		return
+	}
+
+	c.logger.WithField("reason", reason).Info("Consumer resumed")
+	if run != nil {
+		run.group.ResumeAll()
+	}
+}
+
+// pauseClaim приостанавливает чтение партиции, назначенной приостановленному консьюмеру:
+// после ребалансировки или если Pause вызван до Start. sarama создаёт консьюмеры партиций
+// сессии после Setup, поэтому PauseAll в setPaused, Start или Setup до них не дошёл бы,
+// и партиции заполняли бы буферы, пока обработку держит waitResumed.
+func (c *Consumer) pauseClaim(claim sarama.ConsumerGroupClaim) {
+	if len(c.pauses.list()) == 0 {
+		return
+	}
+
+	c.runMu.Lock()
+	run := c.run
+	c.runMu.Unlock()
+	if run == nil {
+		return
+	}
+
+	partitions := map[string][]int32{claim.Topic(): {claim.Partition()}}
+	run.group.Pause(partitions)
+	// Resume мог вызвать ResumeAll до того, как партиция приостановлена
+	if len(c.pauses.list()) == 0 {
+		run.group.Resume(partitions)
+	}
+}
+
+// waitResumed ждёт, пока консьюмер приостановлен. Возвращает errPartitionStopped,
+// если сессия завершилась или консьюмер останавливается.
+func (c *Consumer) waitResumed(session sarama.ConsumerGroupSession) error {
+	select {
+	case <-c.pauses.wait():
+		return nil
+	case <-session.Context().Done():
+		return errPartitionStopped
+	case <-c.stopping:
+		return errPartitionStopped
+	}
+}
+
+// checkHealth проверяет зависимости и приостанавливает консьюмер, если какая-то недоступна
+func (c *Consumer) checkHealth(ctx context.Context) error {
+	for _, check := range c.checkers {
+		checkCtx, cancel := context.WithTimeout(ctx, c.config.HealthCheckInterval)
+		err := check.checker.Check(checkCtx)
+		cancel()
+
+		if err != nil {
+			err = fmt.Errorf("%s is unhealthy: %w", check.name, err)
+			if !c.pauses.has(PauseReasonHealth) {
+				c.logger.WithError(err).Error("Dependency is unhealthy, pausing consumer")
+			}
+			c.setPaused(PauseReasonHealth, true)
+			return err
+		}
+	}
+
+	if c.pauses.has(PauseReasonHealth) {
+		c.logger.Info("Dependencies recovered")
+		c.setPaused(PauseReasonHealth, false)
+	}
+	return nil
+}
+
+// monitorHealth периодически проверяет зависимости, пока не отменён ctx
+func (c *Consumer) monitorHealth(ctx context.Context) {
+	if len(c.checkers) == 0 || c.config.HealthCheckInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.config.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.checkHealth(ctx); err != nil && ctx.Err() == nil {
+			c.logger.WithError(err).Debug("Health check failed")
+		}
+	}
+}
+
+// awaitHealthy вызывается после ошибки обработки. Если консьюмер приостановлен или
+// недоступна зависимость, ошибка вызвана не сообщением: оно ждёт возобновления
+// консьюмера и обрабатывается заново. Возвращает true, если пришлось ждать.
+func (c *Consumer) awaitHealthy(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage) (bool, error) {
+	if len(c.pauses.list()) == 0 {
+		if len(c.checkers) == 0 || c.config.HealthCheckInterval <= 0 {
+			return false, nil
+		}
+		// Сессия завершается (ребалансировка, остановка): сообщение не обрабатывается
+		// дальше. Проверка не зависит от отмены сессии, иначе отмена посреди проверки
+		// приостановила бы консьюмер при здоровых зависимостях.
+		if session.Context().Err() != nil {
+			return true, errPartitionStopped
+		}
+		if err := c.checkHealth(context.WithoutCancel(session.Context())); err == nil {
+			return false, nil
+		}
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"topic":     message.Topic,
+		"partition": message.Partition,
+		"offset":    message.Offset,
+		"paused":    c.PauseReasons(),
+	}).Warn("Consumer is paused, message waits for resume")
+
+	if err := c.waitResumed(session); err != nil {
+		return true, err
+	}
+	return true, nil
+}
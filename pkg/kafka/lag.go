@@ -0,0 +1,193 @@
+package kafka
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lagRefreshInterval — как часто фоновый сборщик пересчитывает лаг назначенных партиций
+const lagRefreshInterval = time.Second * 30
+
+// partitionLag — позиция консьюмера и high watermark одной партиции
+type partitionLag struct {
+	highWaterMark int64 // Offset следующего сообщения, которое будет записано в партицию, -1 - неизвестен
+	position      int64 // Offset следующего необработанного сообщения, -1 - неизвестен
+}
+
+// lagTracker хранит позиции партиций, назначенных консьюмеру в текущей сессии,
+// и публикует лаг в ConsumerMetrics.Lag
+type lagTracker struct {
+	mu      sync.Mutex
+	groupID string
+	gauge   *prometheus.GaugeVec
+	claims  map[string]map[int32]*partitionLag
+}
+
+// newLagTracker создаёт трекер лага консьюмер-группы
+func newLagTracker(groupID string, gauge *prometheus.GaugeVec) *lagTracker {
+	return &lagTracker{
+		groupID: groupID,
+		gauge:   gauge,
+		claims:  make(map[string]map[int32]*partitionLag),
+	}
+}
+
+// assign запоминает партиции новой сессии
+func (t *lagTracker) assign(claims map[string][]int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for topic, partitions := range claims {
+		t.claims[topic] = make(map[int32]*partitionLag, len(partitions))
+		for _, partition := range partitions {
+			t.claims[topic][partition] = &partitionLag{highWaterMark: -1, position: -1}
+		}
+	}
+}
+
+// revoke забывает партиции завершённой сессии и удаляет их лаг из метрик,
+// чтобы отданные другому консьюмеру партиции не показывали устаревшее значение
+func (t *lagTracker) revoke() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for topic, partitions := range t.claims {
+		for partition := range partitions {
+			t.gauge.DeleteLabelValues(topic, strconv.Itoa(int(partition)), t.groupID)
+		}
+	}
+	t.claims = make(map[string]map[int32]*partitionLag)
+}
+
+// snapshot возвращает назначенные партиции
+func (t *lagTracker) snapshot() map[string][]int32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	claims := make(map[string][]int32, len(t.claims))
+	for topic, partitions := range t.claims {
+		for partition := range partitions {
+			claims[topic] = append(claims[topic], partition)
+		}
+	}
+	return claims
+}
+
+// observe обновляет high watermark партиции
+func (t *lagTracker) observe(topic string, partition int32, highWaterMark int64) {
+	t.update(topic, partition, func(lag *partitionLag) {
+		lag.highWaterMark = highWaterMark
+	})
+}
+
+// advance сдвигает позицию партиции: next - offset следующего необработанного сообщения.
+// Позиция не откатывается, если данные сборщика пришли позже коммита.
+func (t *lagTracker) advance(topic string, partition int32, next int64) {
+	t.update(topic, partition, func(lag *partitionLag) {
+		if next > lag.position {
+			lag.position = next
+		}
+	})
+}
+
+// update изменяет данные назначенной партиции и публикует её лаг
+func (t *lagTracker) update(topic string, partition int32, change func(*partitionLag)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lag, ok := t.claims[topic][partition]
+	if !ok {
+		return
+	}
+	change(lag)
+
+	if lag.position < 0 || lag.highWaterMark < 0 {
+		return
+	}
+	value := lag.highWaterMark - lag.position
+	if value < 0 {
+		value = 0
+	}
+	t.gauge.WithLabelValues(topic, strconv.Itoa(int(partition)), t.groupID).Set(float64(value))
+}
+
+// collectLag периодически пересчитывает лаг назначенных партиций, в том числе тех,
+// из которых давно не приходили сообщения. Позиция берётся из закоммиченных offset'ов
+// группы (в PostgreSQL в режиме offset store), high watermark - из метаданных брокера.
+func (c *Consumer) collectLag(ctx context.Context, client sarama.Client, admin sarama.ClusterAdmin) {
+	ticker := time.NewTicker(lagRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		claims := c.lag.snapshot()
+		if len(claims) == 0 {
+			continue
+		}
+
+		committed, err := c.committedOffsets(ctx, admin, claims)
+		if err != nil {
+			c.logger.WithError(err).Warn("Failed to fetch committed offsets for lag")
+			continue
+		}
+
+		for topic, partitions := range claims {
+			for _, partition := range partitions {
+				highWaterMark, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+				if err != nil {
+					c.logger.WithError(err).WithField("topic", topic).Warn("Failed to fetch high watermark for lag")
+					continue
+				}
+
+				c.lag.observe(topic, partition, highWaterMark)
+				if offset, ok := committed[topic][partition]; ok {
+					c.lag.advance(topic, partition, offset)
+				}
+			}
+		}
+	}
+}
+
+// committedOffsets возвращает закоммиченные offset'ы группы для партиций.
+// Партиции без закоммиченного offset'а в результат не попадают.
+func (c *Consumer) committedOffsets(ctx context.Context, admin sarama.ClusterAdmin, claims map[string][]int32) (map[string]map[int32]int64, error) {
+	committed := make(map[string]map[int32]int64, len(claims))
+
+	if c.offsets != nil {
+		for topic, partitions := range claims {
+			offsets, err := c.offsets.load(ctx, topic, partitions)
+			if err != nil {
+				return nil, err
+			}
+			committed[topic] = offsets
+		}
+		return committed, nil
+	}
+
+	response, err := admin.ListConsumerGroupOffsets(c.config.GroupID, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	for topic, partitions := range claims {
+		committed[topic] = make(map[int32]int64, len(partitions))
+		for _, partition := range partitions {
+			block := response.GetBlock(topic, partition)
+			if block == nil || block.Err != sarama.ErrNoError || block.Offset < 0 {
+				continue
+			}
+			committed[topic][partition] = block.Offset
+		}
+	}
+	return committed, nil
+}
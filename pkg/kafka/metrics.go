@@ -0,0 +1,209 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// consumerLabels — метки метрик консьюмера
+var consumerLabels = []string{"topic", "partition", "group"}
+
+// ConsumerMetrics содержит метрики для мониторинга. Метрики размечены топиком, партицией
+// и консьюмер-группой, поэтому несколько консьюмеров одного процесса пишут в общие метрики.
+type ConsumerMetrics struct {
+	MessagesProcessed *prometheus.CounterVec
+	ProcessingTime    *prometheus.HistogramVec
+	Errors            *prometheus.CounterVec
+	Retries           *prometheus.CounterVec
+	DLQMessages       *prometheus.CounterVec
+	Unhandled         *prometheus.CounterVec // Дополнительно размечена меткой failure_policy
+	BatchSize         *prometheus.HistogramVec
+	Timeouts          *prometheus.CounterVec
+	Panics            *prometheus.CounterVec
+	Lag               *prometheus.GaugeVec
+	Rebalances        *prometheus.CounterVec   // Размечена только меткой group
+	RebalanceDuration *prometheus.HistogramVec // Размечена только меткой group
+	Paused            *prometheus.GaugeVec     // Размечена метками group и reason
+
+	groupID string
+}
+
+// NewConsumerMetrics регистрирует метрики консьюмер-группы в registerer. Если метрики
+// уже зарегистрированы другим консьюмером, используются существующие.
+func NewConsumerMetrics(registerer prometheus.Registerer, groupID string) (*ConsumerMetrics, error) {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+
+	m := &ConsumerMetrics{groupID: groupID}
+	var err error
+
+	if m.MessagesProcessed, err = registerCounterVec(registerer, prometheus.CounterOpts{
+		Name: "kafka_messages_processed_total",
+		Help: "Total number of processed messages",
+	}, consumerLabels); err != nil {
+		return nil, err
+	}
+	if m.ProcessingTime, err = registerHistogramVec(registerer, prometheus.HistogramOpts{
+		Name: "kafka_message_processing_duration_seconds",
+		Help: "Time spent processing messages",
+	}, consumerLabels); err != nil {
+		return nil, err
+	}
+	if m.Errors, err = registerCounterVec(registerer, prometheus.CounterOpts{
+		Name: "kafka_processing_errors_total",
+		Help: "Total number of processing errors",
+	}, consumerLabels); err != nil {
+		return nil, err
+	}
+	if m.Retries, err = registerCounterVec(registerer, prometheus.CounterOpts{
+		Name: "kafka_retries_total",
+		Help: "Total number of retries",
+	}, consumerLabels); err != nil {
+		return nil, err
+	}
+	if m.DLQMessages, err = registerCounterVec(registerer, prometheus.CounterOpts{
+		Name: "kafka_dlq_messages_total",
+		Help: "Total number of messages sent to DLQ",
+	}, consumerLabels); err != nil {
+		return nil, err
+	}
+	if m.Unhandled, err = registerCounterVec(registerer, prometheus.CounterOpts{
+		Name: "kafka_unhandled_messages_total",
+		Help: "Total number of failed messages that could not be sent to DLQ",
+	}, append(append([]string{}, consumerLabels...), "failure_policy")); err != nil {
+		return nil, err
+	}
+	if m.BatchSize, err = registerHistogramVec(registerer, prometheus.HistogramOpts{
+		Name:    "kafka_batch_size",
+		Help:    "Number of messages in processed batches",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 11),
+	}, consumerLabels); err != nil {
+		return nil, err
+	}
+	if m.Timeouts, err = registerCounterVec(registerer, prometheus.CounterOpts{
+		Name: "kafka_processing_timeouts_total",
+		Help: "Total number of processing attempts that exceeded the processing timeout",
+	}, consumerLabels); err != nil {
+		return nil, err
+	}
+	if m.Panics, err = registerCounterVec(registerer, prometheus.CounterOpts{
+		Name: "kafka_handler_panics_total",
+		Help: "Total number of recovered handler panics",
+	}, consumerLabels); err != nil {
+		return nil, err
+	}
+	if m.Lag, err = registerGaugeVec(registerer, prometheus.GaugeOpts{
+		Name: "kafka_consumer_lag",
+		Help: "Number of messages in the partition not yet processed by the consumer group",
+	}, consumerLabels); err != nil {
+		return nil, err
+	}
+	if m.Rebalances, err = registerCounterVec(registerer, prometheus.CounterOpts{
+		Name: "kafka_consumer_rebalances_total",
+		Help: "Total number of completed consumer group rebalances",
+	}, []string{"group"}); err != nil {
+		return nil, err
+	}
+	if m.RebalanceDuration, err = registerHistogramVec(registerer, prometheus.HistogramOpts{
+		Name:    "kafka_consumer_rebalance_duration_seconds",
+		Help:    "Time from revoking partitions (or joining the group) to the next assignment",
+		Buckets: []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"group"}); err != nil {
+		return nil, err
+	}
+	if m.Paused, err = registerGaugeVec(registerer, prometheus.GaugeOpts{
+		Name: "kafka_consumer_paused",
+		Help: "Whether the consumer is paused for the reason (manual or unhealthy dependency)",
+	}, []string{"group", "reason"}); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// labels возвращает значения меток topic, partition и group для сообщения
+func (m *ConsumerMetrics) labels(message *sarama.ConsumerMessage) []string {
+	return []string{message.Topic, strconv.Itoa(int(message.Partition)), m.groupID}
+}
+
+// registerCounterVec регистрирует CounterVec или возвращает уже зарегистрированный
+func registerCounterVec(registerer prometheus.Registerer, opts prometheus.CounterOpts, labels []string) (*prometheus.CounterVec, error) {
+	collector, err := register(registerer, prometheus.NewCounterVec(opts, labels))
+	if err != nil {
+		return nil, err
+	}
+	vec, ok := collector.(*prometheus.CounterVec)
+	if !ok {
+		return nil, fmt.Errorf("metric %s is already registered with another type", opts.Name)
+	}
+	return vec, nil
+}
+
+// registerHistogramVec регистрирует HistogramVec или возвращает уже зарегистрированный
+func registerHistogramVec(registerer prometheus.Registerer, opts prometheus.HistogramOpts, labels []string) (*prometheus.HistogramVec, error) {
+	collector, err := register(registerer, prometheus.NewHistogramVec(opts, labels))
+	if err != nil {
+		return nil, err
+	}
+	vec, ok := collector.(*prometheus.HistogramVec)
+	if !ok {
+		return nil, fmt.Errorf("metric %s is already registered with another type", opts.Name)
+	}
+	return vec, nil
+}
+
+// registerGaugeVec регистрирует GaugeVec или возвращает уже зарегистрированный
+func registerGaugeVec(registerer prometheus.Registerer, opts prometheus.GaugeOpts, labels []string) (*prometheus.GaugeVec, error) {
+	collector, err := register(registerer, prometheus.NewGaugeVec(opts, labels))
+	if err != nil {
+		return nil, err
+	}
+	vec, ok := collector.(*prometheus.GaugeVec)
+	if !ok {
+		return nil, fmt.Errorf("metric %s is already registered with another type", opts.Name)
+	}
+	return vec, nil
+}
+
+// mustRegisterCounterVec регистрирует CounterVec в registerer (nil - prometheus.DefaultRegisterer)
+// или возвращает уже зарегистрированный. Паникует, как promauto, при конфликте типов.
+func mustRegisterCounterVec(registerer prometheus.Registerer, opts prometheus.CounterOpts, labels []string) *prometheus.CounterVec {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	vec, err := registerCounterVec(registerer, opts, labels)
+	if err != nil {
+		panic(err)
+	}
+	return vec
+}
+
+// mustRegisterHistogramVec регистрирует HistogramVec в registerer (nil - prometheus.DefaultRegisterer)
+// или возвращает уже зарегистрированный. Паникует, как promauto, при конфликте типов.
+func mustRegisterHistogramVec(registerer prometheus.Registerer, opts prometheus.HistogramOpts, labels []string) *prometheus.HistogramVec {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	vec, err := registerHistogramVec(registerer, opts, labels)
+	if err != nil {
+		panic(err)
+	}
+	return vec
+}
+
+// register регистрирует коллектор, а если такой уже есть - возвращает существующий
+func register(registerer prometheus.Registerer, collector prometheus.Collector) (prometheus.Collector, error) {
+	if err := registerer.Register(collector); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if errors.As(err, &registered) {
+			return registered.ExistingCollector, nil
+		}
+		return nil, fmt.Errorf("failed to register metrics: %w", err)
+	}
+	return collector, nil
+}
@@ -2,10 +2,18 @@ package kafka
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"runtime/debug"
+	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
@@ -49,6 +57,32 @@ func (m *LoggingMiddleware) Process(ctx context.Context, message *sarama.Consume
 	return err
 }
 
+// ProcessBatch логирует обработку пакета
+func (m *LoggingMiddleware) ProcessBatch(ctx context.Context, messages []*sarama.ConsumerMessage, next func(context.Context, []*sarama.ConsumerMessage) error) error {
+	start := time.Now()
+	first, last := messages[0], messages[len(messages)-1]
+
+	fields := logrus.Fields{
+		"topic":        first.Topic,
+		"partition":    first.Partition,
+		"first_offset": first.Offset,
+		"last_offset":  last.Offset,
+		"batch_size":   len(messages),
+	}
+	m.logger.WithFields(fields).Debug("Processing batch")
+
+	err := next(ctx, messages)
+
+	fields["duration"] = time.Since(start)
+	if err != nil {
+		m.logger.WithError(err).WithFields(fields).Error("Batch processing failed")
+	} else {
+		m.logger.WithFields(fields).Info("Batch processed successfully")
+	}
+
+	return err
+}
+
 // MetricsMiddleware собирает метрики обработки
 type MetricsMiddleware struct {
 	metrics *ConsumerMetrics
@@ -66,59 +100,211 @@ func (m *MetricsMiddleware) Process(ctx context.Context, message *sarama.Consume
 	err := next(ctx, message)
 
 	duration := time.Since(start)
-	m.metrics.ProcessingTime.Observe(duration.Seconds())
+	labels := m.metrics.labels(message)
+	m.metrics.ProcessingTime.WithLabelValues(labels...).Observe(duration.Seconds())
 
 	if err != nil {
-		m.metrics.Errors.Inc()
+		m.metrics.Errors.WithLabelValues(labels...).Inc()
 	} else {
-		m.metrics.MessagesProcessed.Inc()
+		m.metrics.MessagesProcessed.WithLabelValues(labels...).Inc()
 	}
 
 	return err
 }
 
-// RetryMiddleware реализует логику повторов
-type RetryMiddleware struct {
-	maxRetries int
-	retryDelay time.Duration
-	logger     *logrus.Logger
+// ProcessBatch собирает метрики обработки пакета
+func (m *MetricsMiddleware) ProcessBatch(ctx context.Context, messages []*sarama.ConsumerMessage, next func(context.Context, []*sarama.ConsumerMessage) error) error {
+	start := time.Now()
+
+	err := next(ctx, messages)
+
+	labels := m.metrics.labels(messages[0])
+	m.metrics.ProcessingTime.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		m.metrics.Errors.WithLabelValues(labels...).Inc()
+	} else {
+		m.metrics.MessagesProcessed.WithLabelValues(labels...).Add(float64(len(messages)))
+	}
+
+	return err
 }
 
-// NewRetryMiddleware создаёт новый RetryMiddleware
-func NewRetryMiddleware(maxRetries int, retryDelay time.Duration, logger *logrus.Logger) *RetryMiddleware {
-	return &RetryMiddleware{
-		maxRetries: maxRetries,
-		retryDelay: retryDelay,
-		logger:     logger,
+// TimeoutMiddleware ограничивает каждую попытку обработки временем Config.ProcessingTimeout.
+// Обработчик должен передавать контекст в запросы к базе и Kafka: middleware отменяет
+// контекст, но не может прервать код, который его не проверяет.
+type TimeoutMiddleware struct {
+	timeout time.Duration
+	metrics *ConsumerMetrics
+	logger  *logrus.Logger
+}
+
+// NewTimeoutMiddleware создаёт новый TimeoutMiddleware
+func NewTimeoutMiddleware(timeout time.Duration, metrics *ConsumerMetrics, logger *logrus.Logger) *TimeoutMiddleware {
+	return &TimeoutMiddleware{
+		timeout: timeout,
+		metrics: metrics,
+		logger:  logger,
 	}
 }
 
-// Process обрабатывает сообщение с логикой повторов
-func (m *RetryMiddleware) Process(ctx context.Context, message *sarama.ConsumerMessage, next func(context.Context, *sarama.ConsumerMessage) error) error {
-	var lastErr error
+// Process обрабатывает сообщение с таймаутом
+func (m *TimeoutMiddleware) Process(ctx context.Context, message *sarama.ConsumerMessage, next func(context.Context, *sarama.ConsumerMessage) error) error {
+	attemptCtx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	err := m.timeoutError(ctx, attemptCtx, message, next(attemptCtx, message))
+	if IsTimeout(err) {
+		m.logger.WithFields(logrus.Fields{
+			"topic":     message.Topic,
+			"partition": message.Partition,
+			"offset":    message.Offset,
+			"timeout":   m.timeout,
+		}).Warn("Message processing timed out")
+	}
+	return err
+}
+
+// ProcessBatch обрабатывает пакет с таймаутом на весь пакет
+func (m *TimeoutMiddleware) ProcessBatch(ctx context.Context, messages []*sarama.ConsumerMessage, next func(context.Context, []*sarama.ConsumerMessage) error) error {
+	attemptCtx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
 
-	for attempt := 0; attempt <= m.maxRetries; attempt++ {
-		if attempt > 0 {
-			m.logger.WithFields(logrus.Fields{
-				"attempt":   attempt,
+	err := m.timeoutError(ctx, attemptCtx, messages[0], next(attemptCtx, messages))
+	if IsTimeout(err) {
+		m.logger.WithFields(logrus.Fields{
+			"topic":      messages[0].Topic,
+			"partition":  messages[0].Partition,
+			"batch_size": len(messages),
+			"timeout":    m.timeout,
+		}).Warn("Batch processing timed out")
+	}
+	return err
+}
+
+// timeoutError помечает ошибку попытки как таймаут, если истёк таймаут попытки,
+// а не завершилась сессия консьюмера. Постоянные ошибки остаются постоянными.
+func (m *TimeoutMiddleware) timeoutError(ctx, attemptCtx context.Context, message *sarama.ConsumerMessage, err error) error {
+	if err == nil || IsPermanent(err) || ctx.Err() != nil || !errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+
+	m.metrics.Timeouts.WithLabelValues(m.metrics.labels(message)...).Inc()
+	return &timeoutError{err: err, timeout: m.timeout}
+}
+
+// RecoveryMiddleware перехватывает панику обработчика и превращает её в постоянную
+// ошибку: сообщение уходит в DLQ, а консьюмер продолжает работу
+type RecoveryMiddleware struct {
+	metrics *ConsumerMetrics
+	logger  *logrus.Logger
+}
+
+// NewRecoveryMiddleware создаёт новый RecoveryMiddleware
+func NewRecoveryMiddleware(metrics *ConsumerMetrics, logger *logrus.Logger) *RecoveryMiddleware {
+	return &RecoveryMiddleware{
+		metrics: metrics,
+		logger:  logger,
+	}
+}
+
+// Process обрабатывает сообщение, перехватывая панику
+func (m *RecoveryMiddleware) Process(ctx context.Context, message *sarama.ConsumerMessage, next func(context.Context, *sarama.ConsumerMessage) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = m.recovered(r, message, logrus.Fields{
 				"topic":     message.Topic,
 				"partition": message.Partition,
 				"offset":    message.Offset,
-			}).Warn("Retrying message processing")
+			})
+		}
+	}()
 
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case <-time.After(m.retryDelay):
-				// Продолжаем после задержки
-			}
+	return next(ctx, message)
+}
+
+// ProcessBatch обрабатывает пакет, перехватывая панику. Пакет затем обрабатывается
+// по одному сообщению, и в DLQ попадает только сообщение, вызвавшее панику.
+func (m *RecoveryMiddleware) ProcessBatch(ctx context.Context, messages []*sarama.ConsumerMessage, next func(context.Context, []*sarama.ConsumerMessage) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = m.recovered(r, messages[0], logrus.Fields{
+				"topic":        messages[0].Topic,
+				"partition":    messages[0].Partition,
+				"first_offset": messages[0].Offset,
+				"batch_size":   len(messages),
+			})
 		}
+	}()
+
+	return next(ctx, messages)
+}
+
+// recovered логирует панику со стеком и возвращает постоянную ошибку
+func (m *RecoveryMiddleware) recovered(value interface{}, message *sarama.ConsumerMessage, fields logrus.Fields) error {
+	m.metrics.Panics.WithLabelValues(m.metrics.labels(message)...).Inc()
+	m.logger.WithFields(fields).WithFields(logrus.Fields{
+		"panic": fmt.Sprint(value),
+		"stack": string(debug.Stack()),
+	}).Error("Handler panicked")
+
+	return Permanent(fmt.Errorf("handler panicked: %v", value))
+}
+
+// RetryPolicy описывает повторы с экспоненциальной задержкой и случайным разбросом
+type RetryPolicy struct {
+	MaxRetries     int           // Повторов после первой попытки
+	InitialDelay   time.Duration // Задержка перед первым повтором
+	MaxDelay       time.Duration // Верхняя граница задержки
+	Multiplier     float64       // Во сколько раз растёт задержка с каждым повтором
+	Jitter         float64       // Доля случайного разброса задержки, от 0 до 1
+	MaxElapsedTime time.Duration // Общее время на повторы, 0 - без ограничения
+}
+
+// Delay возвращает задержку перед повтором attempt (начиная с 1)
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := float64(p.InitialDelay)
+	if p.Multiplier > 1 {
+		delay *= math.Pow(p.Multiplier, float64(attempt-1))
+	}
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+
+	// Разброс не даёт консьюмерам повторять одновременно после общего сбоя
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+
+	return time.Duration(delay)
+}
+
+// RetryMiddleware реализует логику повторов
+type RetryMiddleware struct {
+	policy RetryPolicy
+	logger *logrus.Logger
+}
+
+// NewRetryMiddleware создаёт новый RetryMiddleware
+func NewRetryMiddleware(policy RetryPolicy, logger *logrus.Logger) *RetryMiddleware {
+	return &RetryMiddleware{
+		policy: policy,
+		logger: logger,
+	}
+}
 
+// Process обрабатывает сообщение с логикой повторов
+func (m *RetryMiddleware) Process(ctx context.Context, message *sarama.ConsumerMessage, next func(context.Context, *sarama.ConsumerMessage) error) error {
+	start := time.Now()
+	attempts := 0
+
+	for {
 		err := next(ctx, message)
+		attempts++
 		if err == nil {
-			if attempt > 0 {
+			if attempts > 1 {
 				m.logger.WithFields(logrus.Fields{
-					"attempt":   attempt,
+					"attempt":   attempts - 1,
 					"topic":     message.Topic,
 					"partition": message.Partition,
 					"offset":    message.Offset,
@@ -127,8 +313,6 @@ func (m *RetryMiddleware) Process(ctx context.Context, message *sarama.ConsumerM
 			return nil
 		}
 
-		lastErr = err
-
 		// Проверяем, стоит ли повторять попытку
 		if !isRetryableError(err) {
 			m.logger.WithError(err).WithFields(logrus.Fields{
@@ -136,22 +320,246 @@ func (m *RetryMiddleware) Process(ctx context.Context, message *sarama.ConsumerM
 				"partition": message.Partition,
 				"offset":    message.Offset,
 			}).Error("Non-retryable error, giving up")
-			break
+			return fmt.Errorf("failed after %d attempts: %w", attempts, err)
+		}
+
+		if attempts > m.policy.MaxRetries {
+			return fmt.Errorf("failed after %d attempts: %w", attempts, err)
+		}
+
+		delay := m.policy.Delay(attempts)
+		if m.policy.MaxElapsedTime > 0 && time.Since(start)+delay > m.policy.MaxElapsedTime {
+			return fmt.Errorf("failed after %d attempts in %s: %w", attempts, time.Since(start).Round(time.Millisecond), err)
 		}
-	}
 
-	return fmt.Errorf("failed after %d attempts: %w", m.maxRetries+1, lastErr)
+		m.logger.WithError(err).WithFields(logrus.Fields{
+			"attempt":   attempts,
+			"delay":     delay,
+			"topic":     message.Topic,
+			"partition": message.Partition,
+			"offset":    message.Offset,
+		}).Warn("Retrying message processing")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+			// Продолжаем после задержки
+		}
+	}
 }
 
-// isRetryableError определяет, можно ли повторить попытку при данной ошибке
+// isRetryableError определяет, можно ли повторить попытку при данной ошибке.
+// Ошибки, помеченные Transient, и таймауты попытки повторяются всегда, Permanent
+// и контекстные - никогда, остальные считаются временными.
 func isRetryableError(err error) bool {
-	// Здесь можно добавить логику определения повторяемых ошибок
-	// Например, временные сетевые ошибки, ошибки базы данных и т.д.
+	if errors.Is(err, ErrTransient) {
+		return true
+	}
 
-	// Пока что считаем все ошибки повторяемыми, кроме контекстных
-	if err == context.Canceled || err == context.DeadlineExceeded {
+	if IsPermanent(err) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 		return false
 	}
 
 	return true
 }
+
+// eventIDHeader — заголовок с идентификатором события, который выставляет продюсер
+const eventIDHeader = "event_id"
+
+// dedupCleanupInterval — как часто DedupMiddleware удаляет устаревшие записи inbox
+const dedupCleanupInterval = time.Hour
+
+// headerValue возвращает значение заголовка сообщения или пустую строку
+func headerValue(message *sarama.ConsumerMessage, key string) string {
+	for _, header := range message.Headers {
+		if header != nil && string(header.Key) == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+// DedupMiddleware пропускает повторно доставленные события. Обработанные пары
+// (consumer_group, event_id) хранятся в таблице insurance.inbox. Запись inbox вставляется
+// до вызова обработчика в транзакции попытки, которую обработчик получает через
+// QuerierFromContext: она коммитится вместе с его изменениями, а параллельная доставка
+// того же события ждёт на уникальном ключе и пропускается. Консьюмеру нужна база данных.
+type DedupMiddleware struct {
+	db         *sql.DB
+	groupID    string
+	retention  time.Duration
+	logger     *logrus.Logger
+	duplicates prometheus.Counter
+
+	cleanupMu   sync.Mutex
+	lastCleanup time.Time
+}
+
+// NewDedupMiddleware создаёт новый DedupMiddleware. Записи inbox старше retention удаляются,
+// поэтому retention должен превышать максимальное время повторной доставки события.
+// Метрики регистрируются в registerer, nil - prometheus.DefaultRegisterer.
+func NewDedupMiddleware(db *sql.DB, groupID string, retention time.Duration, registerer prometheus.Registerer, logger *logrus.Logger) *DedupMiddleware {
+	return &DedupMiddleware{
+		db:        db,
+		groupID:   groupID,
+		retention: retention,
+		logger:    logger,
+		duplicates: mustRegisterCounterVec(registerer, prometheus.CounterOpts{
+			Name: "kafka_dedup_skipped_total",
+			Help: "Total number of skipped duplicate messages",
+		}, []string{"group"}).WithLabelValues(groupID),
+	}
+}
+
+// Process обрабатывает сообщение, если его event_id ещё не встречался в группе
+func (m *DedupMiddleware) Process(ctx context.Context, message *sarama.ConsumerMessage, next func(context.Context, *sarama.ConsumerMessage) error) error {
+	eventID := headerValue(message, eventIDHeader)
+	if eventID == "" {
+		// Без event_id дедуплицировать нечего
+		return next(ctx, message)
+	}
+
+	m.cleanupIfDue()
+
+	ctx, tx, err := beginHandlerTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO insurance.inbox (consumer_group, event_id, processed_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (consumer_group, event_id) DO NOTHING`,
+		m.groupID, eventID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record event in inbox: %w", err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to record event in inbox: %w", err)
+	}
+
+	if inserted == 0 {
+		m.duplicates.Inc()
+		m.logger.WithFields(logrus.Fields{
+			"event_id":  eventID,
+			"topic":     message.Topic,
+			"partition": message.Partition,
+			"offset":    message.Offset,
+		}).Info("Duplicate event, skipping")
+		return nil
+	}
+
+	return next(ctx, message)
+}
+
+// ProcessBatch записывает события пакета в inbox одним запросом и передаёт дальше
+// только те, которые ещё не встречались в группе
+func (m *DedupMiddleware) ProcessBatch(ctx context.Context, messages []*sarama.ConsumerMessage, next func(context.Context, []*sarama.ConsumerMessage) error) error {
+	eventIDs := make([]string, 0, len(messages))
+	for _, message := range messages {
+		if eventID := headerValue(message, eventIDHeader); eventID != "" {
+			eventIDs = append(eventIDs, eventID)
+		}
+	}
+	if len(eventIDs) == 0 {
+		return next(ctx, messages)
+	}
+
+	m.cleanupIfDue()
+
+	ctx, tx, err := beginHandlerTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		INSERT INTO insurance.inbox (consumer_group, event_id, processed_at)
+		SELECT $1, event_id, NOW() FROM UNNEST($2::text[]) AS event_id
+		ON CONFLICT (consumer_group, event_id) DO NOTHING
+		RETURNING event_id`,
+		m.groupID, pq.Array(eventIDs),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record events in inbox: %w", err)
+	}
+	inserted := make(map[string]bool)
+	for rows.Next() {
+		var eventID string
+		if err := rows.Scan(&eventID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan inbox: %w", err)
+		}
+		inserted[eventID] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to record events in inbox: %w", err)
+	}
+
+	// Дубликаты отбрасываются и внутри самого пакета: обрабатывается первое вхождение
+	fresh := make([]*sarama.ConsumerMessage, 0, len(messages))
+	for _, message := range messages {
+		eventID := headerValue(message, eventIDHeader)
+		if eventID == "" {
+			fresh = append(fresh, message)
+			continue
+		}
+		if !inserted[eventID] {
+			continue
+		}
+		delete(inserted, eventID)
+		fresh = append(fresh, message)
+	}
+
+	if skipped := len(messages) - len(fresh); skipped > 0 {
+		m.duplicates.Add(float64(skipped))
+		m.logger.WithFields(logrus.Fields{
+			"topic":     messages[0].Topic,
+			"partition": messages[0].Partition,
+			"skipped":   skipped,
+		}).Info("Duplicate events in batch, skipping")
+	}
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	return next(ctx, fresh)
+}
+
+// cleanupIfDue запускает очистку inbox в фоне не чаще dedupCleanupInterval
+func (m *DedupMiddleware) cleanupIfDue() {
+	if m.retention <= 0 {
+		return
+	}
+
+	m.cleanupMu.Lock()
+	defer m.cleanupMu.Unlock()
+
+	if time.Since(m.lastCleanup) < dedupCleanupInterval {
+		return
+	}
+	m.lastCleanup = time.Now()
+
+	go m.cleanup()
+}
+
+// cleanup удаляет записи inbox старше retention
+func (m *DedupMiddleware) cleanup() {
+	result, err := m.db.Exec(
+		"DELETE FROM insurance.inbox WHERE consumer_group = $1 AND processed_at < $2",
+		m.groupID, time.Now().Add(-m.retention),
+	)
+	if err != nil {
+		m.logger.WithError(err).Error("Failed to clean up inbox")
+		return
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted > 0 {
+		m.logger.WithField("count", deleted).Info("Expired inbox records removed")
+	}
+}
@@ -0,0 +1,160 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestMetrics создаёт метрики консьюмера в отдельном реестре и логгер без вывода
+func newTestMetrics(t *testing.T) (*ConsumerMetrics, *logrus.Logger) {
+	t.Helper()
+	metrics, err := NewConsumerMetrics(prometheus.NewRegistry(), "billing-service")
+	if err != nil {
+		t.Fatalf("NewConsumerMetrics: %v", err)
+	}
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	return metrics, logger
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	errHandler := errors.New("database is down")
+
+	// waitDeadline ждёт отмены контекста попытки и возвращает err или ошибку контекста
+	waitDeadline := func(err error) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			<-ctx.Done()
+			if err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+	}
+
+	tests := []struct {
+		name          string
+		handler       func(ctx context.Context) error
+		cancelParent  bool // Сессия консьюмера завершена до обработки
+		batch         bool
+		wantErr       error
+		wantTimeout   bool
+		wantPermanent bool
+	}{
+		{name: "success", handler: func(ctx context.Context) error { return nil }},
+		{name: "error before deadline", handler: func(ctx context.Context) error { return errHandler }, wantErr: errHandler},
+		{name: "deadline exceeded", handler: waitDeadline(nil), wantErr: context.DeadlineExceeded, wantTimeout: true},
+		{name: "batch deadline exceeded", handler: waitDeadline(nil), batch: true, wantErr: context.DeadlineExceeded, wantTimeout: true},
+		{name: "handler error after deadline", handler: waitDeadline(errHandler), wantErr: errHandler, wantTimeout: true},
+		{name: "permanent error after deadline", handler: waitDeadline(Permanent(errHandler)), wantErr: errHandler, wantPermanent: true},
+		{name: "session canceled", handler: waitDeadline(nil), cancelParent: true, wantErr: context.Canceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, logger := newTestMetrics(t)
+			middleware := NewTimeoutMiddleware(time.Millisecond*10, metrics, logger)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancelParent {
+				cancel()
+			}
+
+			message := &sarama.ConsumerMessage{Topic: "auto.events", Partition: 1}
+			var err error
+			if tt.batch {
+				err = middleware.ProcessBatch(ctx, []*sarama.ConsumerMessage{message}, func(ctx context.Context, _ []*sarama.ConsumerMessage) error {
+					return tt.handler(ctx)
+				})
+			} else {
+				err = middleware.Process(ctx, message, func(ctx context.Context, _ *sarama.ConsumerMessage) error {
+					return tt.handler(ctx)
+				})
+			}
+
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("Process() error = %v, want nil", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Process() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := IsTimeout(err); got != tt.wantTimeout {
+				t.Errorf("IsTimeout() = %v, want %v", got, tt.wantTimeout)
+			}
+			if got := IsPermanent(err); got != tt.wantPermanent {
+				t.Errorf("IsPermanent() = %v, want %v", got, tt.wantPermanent)
+			}
+
+			want := 0.0
+			if tt.wantTimeout {
+				want = 1
+			}
+			if got := testutil.ToFloat64(metrics.Timeouts.WithLabelValues(metrics.labels(message)...)); got != want {
+				t.Errorf("timeouts = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	errHandler := errors.New("database is down")
+
+	tests := []struct {
+		name          string
+		handler       func() error
+		batch         bool
+		wantErr       error
+		wantPanic     string // Текст паники в ошибке, пусто - паники нет
+		wantPermanent bool
+	}{
+		{name: "success", handler: func() error { return nil }},
+		{name: "error passes through", handler: func() error { return errHandler }, wantErr: errHandler},
+		{name: "panic", handler: func() error { panic("nil map") }, wantPanic: "handler panicked: nil map", wantPermanent: true},
+		{name: "panic with error", handler: func() error { panic(errHandler) }, wantPanic: "handler panicked: database is down", wantPermanent: true},
+		{name: "batch panic", handler: func() error { panic("nil map") }, batch: true, wantPanic: "handler panicked: nil map", wantPermanent: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, logger := newTestMetrics(t)
+			middleware := NewRecoveryMiddleware(metrics, logger)
+
+			message := &sarama.ConsumerMessage{Topic: "auto.events", Partition: 1}
+			var err error
+			if tt.batch {
+				err = middleware.ProcessBatch(context.Background(), []*sarama.ConsumerMessage{message}, func(context.Context, []*sarama.ConsumerMessage) error {
+					return tt.handler()
+				})
+			} else {
+				err = middleware.Process(context.Background(), message, func(context.Context, *sarama.ConsumerMessage) error {
+					return tt.handler()
+				})
+			}
+
+			switch {
+			case tt.wantPanic != "" && (err == nil || err.Error() != tt.wantPanic):
+				t.Errorf("Process() error = %v, want %q", err, tt.wantPanic)
+			case tt.wantPanic == "" && !errors.Is(err, tt.wantErr):
+				t.Errorf("Process() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := IsPermanent(err); got != tt.wantPermanent {
+				t.Errorf("IsPermanent() = %v, want %v", got, tt.wantPermanent)
+			}
+
+			want := 0.0
+			if tt.wantPanic != "" {
+				want = 1
+			}
+			if got := testutil.ToFloat64(metrics.Panics.WithLabelValues(metrics.labels(message)...)); got != want {
+				t.Errorf("panics = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package kafka
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Querier — общий интерфейс *sql.DB и *sql.Tx для обработчиков
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// offsetTxKey — ключ контекста для транзакции обработки сообщения
+type offsetTxKey struct{}
+
+// withOffsetTx добавляет в контекст транзакцию, в которой будет сохранён offset сообщения
+func withOffsetTx(ctx context.Context, tx *sql.Tx) context.Context {
+	return context.WithValue(ctx, offsetTxKey{}, tx)
+}
+
+// TxFromContext возвращает транзакцию, в которой консьюмер сохранит offset обрабатываемого
+// сообщения. Транзакция есть в режиме Config.OffsetStore, при обработке пакета консьюмером
+// с базой данных и если её открыл middleware, например DedupMiddleware: тогда консьюмер
+// коммитит её после обработки.
+func TxFromContext(ctx context.Context) (*sql.Tx, bool) {
+	tx, ok := ctx.Value(offsetTxKey{}).(*sql.Tx)
+	return tx, ok
+}
+
+// handlerTxKey — ключ контекста для транзакции успешной попытки обработки
+type handlerTxKey struct{}
+
+// handlerTx хранит транзакцию обработчика после того, как он вернул управление
+type handlerTx struct {
+	db *sql.DB
+	tx *sql.Tx
+}
+
+// withHandlerTx добавляет в контекст пустое хранилище транзакции обработчика
+func withHandlerTx(ctx context.Context, db *sql.DB) (context.Context, *handlerTx) {
+	handled := &handlerTx{db: db}
+	return context.WithValue(ctx, handlerTxKey{}, handled), handled
+}
+
+// reset откатывает транзакцию прошлой попытки обработки
+func (h *handlerTx) reset() {
+	if h.tx != nil {
+		h.tx.Rollback()
+		h.tx = nil
+	}
+}
+
+// current возвращает транзакцию попытки, если её открыл middleware через beginHandlerTx
+func (h *handlerTx) current(ctx context.Context) (*sql.Tx, bool) {
+	tx, ok := TxFromContext(ctx)
+	return tx, ok && h.tx != nil && tx == h.tx
+}
+
+// beginHandlerTx открывает транзакцию попытки обработки до вызова next. Обработчик получает
+// её через TxFromContext, а консьюмер коммитит вместе с offset'ом: так middleware пишут
+// свои данные атомарно с изменениями обработчика.
+func beginHandlerTx(ctx context.Context) (context.Context, *sql.Tx, error) {
+	handled, ok := ctx.Value(handlerTxKey{}).(*handlerTx)
+	if !ok || handled.db == nil {
+		return ctx, nil, fmt.Errorf("handler transaction requires a consumer with database connection")
+	}
+
+	tx, err := handled.begin(ctx)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return withOffsetTx(ctx, tx), tx, nil
+}
+
+// begin откатывает транзакцию прошлой попытки и открывает новую. Транзакция переживает
+// контекст попытки: его отменяет TimeoutMiddleware, когда обработчик вернул управление,
+// а коммит выполняется позже, в commitMessage.
+func (h *handlerTx) begin(ctx context.Context) (*sql.Tx, error) {
+	h.reset()
+	tx, err := h.db.BeginTx(context.WithoutCancel(ctx), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	h.tx = tx
+	return tx, nil
+}
+
+// QuerierFromContext возвращает транзакцию из контекста, а без неё - переданную базу.
+// Обработчик, который пишет через QuerierFromContext, работает в обоих режимах консьюмера.
+func QuerierFromContext(ctx context.Context, db *sql.DB) Querier {
+	if tx, ok := TxFromContext(ctx); ok {
+		return tx
+	}
+	return db
+}
+
+// offsetStore хранит offset'ы консьюмер-группы в таблице insurance.consumer_offsets
+type offsetStore struct {
+	db      *sql.DB
+	groupID string
+}
+
+// newOffsetStore создаёт хранилище offset'ов для консьюмер-группы
+func newOffsetStore(db *sql.DB, groupID string) *offsetStore {
+	return &offsetStore{db: db, groupID: groupID}
+}
+
+// load возвращает сохранённые offset'ы следующих сообщений для партиций топика.
+// Партиции без сохранённого offset'а в результат не попадают.
+func (s *offsetStore) load(ctx context.Context, topic string, partitions []int32) (map[int32]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT kafka_partition, kafka_offset
+		FROM insurance.consumer_offsets
+		WHERE group_id = $1 AND topic = $2 AND kafka_partition = ANY($3)`,
+		s.groupID, topic, pq.Array(partitions),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load consumer offsets: %w", err)
+	}
+	defer rows.Close()
+
+	offsets := make(map[int32]int64, len(partitions))
+	for rows.Next() {
+		var partition int32
+		var offset int64
+		if err := rows.Scan(&partition, &offset); err != nil {
+			return nil, fmt.Errorf("failed to scan consumer offset: %w", err)
+		}
+		offsets[partition] = offset
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read consumer offsets: %w", err)
+	}
+
+	return offsets, nil
+}
+
+// store сохраняет offset следующего сообщения партиции в рамках транзакции
+func (s *offsetStore) store(ctx context.Context, tx *sql.Tx, topic string, partition int32, next int64) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO insurance.consumer_offsets
+		(group_id, topic, kafka_partition, kafka_offset, updated_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (group_id, topic, kafka_partition)
+		DO UPDATE SET kafka_offset = EXCLUDED.kafka_offset, updated_at = EXCLUDED.updated_at`,
+		s.groupID, topic, partition, next,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store consumer offset: %w", err)
+	}
+	return nil
+}
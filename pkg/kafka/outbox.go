@@ -0,0 +1,447 @@
+package kafka
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// outboxRelayLockID — ключ advisory lock, под которым работает ретранслятор.
+// Одновременно outbox вычитывает только один экземпляр, поэтому порядок сохраняется.
+const outboxRelayLockID = 7_310_001
+
+// outboxMessage представляет сообщение, ожидающее публикации в таблице outbox
+type outboxMessage struct {
+	ID        int64
+	EventID   string
+	Topic     string
+	Key       string
+	Payload   []byte
+	Headers   map[string]string
+	Timestamp time.Time // Время события, timestamp сообщения в Kafka
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// writeOutbox сохраняет сообщение в outbox в рамках переданной транзакции
+func writeOutbox(ctx context.Context, tx *sql.Tx, msg *outboxMessage) (int64, error) {
+	headersJSON, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal outbox headers: %w", err)
+	}
+
+	var id int64
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO insurance.outbox
+		(event_id, topic, message_key, payload, headers, message_timestamp)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`,
+		msg.EventID, msg.Topic, msg.Key, msg.Payload, headersJSON, msg.Timestamp,
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert outbox message: %w", err)
+	}
+
+	return id, nil
+}
+
+// toProducerMessage собирает Kafka сообщение из записи outbox
+func (m *outboxMessage) toProducerMessage() *sarama.ProducerMessage {
+	headers := make([]sarama.RecordHeader, 0, len(m.Headers))
+	for key, value := range m.Headers {
+		headers = append(headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+	}
+
+	return &sarama.ProducerMessage{
+		Topic:     m.Topic,
+		Key:       sarama.StringEncoder(m.Key),
+		Value:     sarama.ByteEncoder(m.Payload),
+		Headers:   headers,
+		Timestamp: m.Timestamp,
+	}
+}
+
+// selectOutboxColumns — список колонок outbox, который читает scanOutboxMessages
+const selectOutboxColumns = "id, event_id, topic, message_key, payload, headers, message_timestamp, attempts, created_at"
+
+// scanOutboxMessages читает записи outbox из результата запроса
+func scanOutboxMessages(rows *sql.Rows) ([]*outboxMessage, error) {
+	defer rows.Close()
+
+	var messages []*outboxMessage
+	for rows.Next() {
+		msg := &outboxMessage{}
+		var key sql.NullString
+		var headersJSON []byte
+		if err := rows.Scan(&msg.ID, &msg.EventID, &msg.Topic, &key, &msg.Payload, &headersJSON, &msg.Timestamp, &msg.Attempts, &msg.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan outbox message: %w", err)
+		}
+		msg.Key = key.String
+		if err := json.Unmarshal(headersJSON, &msg.Headers); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal outbox headers: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read outbox messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// publishOutbox публикует записи outbox по порядку и отмечает их в транзакции.
+// Останавливается на первой ошибке, чтобы не нарушить порядок событий.
+func publishOutbox(ctx context.Context, tx *sql.Tx, producer *Producer, messages []*outboxMessage, logger *logrus.Logger) (map[int64]*DeliveryResult, error) {
+	results := make(map[int64]*DeliveryResult, len(messages))
+
+	for _, msg := range messages {
+		delivered, err := producer.send(ctx, producer.producer, msg.toProducerMessage())
+		if err != nil {
+			logger.WithError(err).WithFields(logrus.Fields{
+				"outbox_id": msg.ID,
+				"event_id":  msg.EventID,
+				"attempts":  msg.Attempts + 1,
+			}).Error("Failed to publish outbox message")
+
+			if _, uerr := tx.ExecContext(ctx, `
+				UPDATE insurance.outbox
+				SET attempts = attempts + 1, last_error = $1
+				WHERE id = $2`,
+				err.Error(), msg.ID,
+			); uerr != nil {
+				return results, fmt.Errorf("failed to record outbox error: %w", uerr)
+			}
+			return results, err
+		}
+
+		result := delivered[0]
+		_, err = tx.ExecContext(ctx, `
+			UPDATE insurance.outbox
+			SET sent_at = NOW(), kafka_partition = $1, kafka_offset = $2, attempts = attempts + 1, last_error = NULL
+			WHERE id = $3`,
+			result.Partition, result.Offset, msg.ID,
+		)
+		if err != nil {
+			return results, fmt.Errorf("failed to mark outbox message as sent: %w", err)
+		}
+		results[msg.ID] = result
+
+		logger.WithFields(logrus.Fields{
+			"outbox_id": msg.ID,
+			"event_id":  msg.EventID,
+			"topic":     result.Topic,
+			"partition": result.Partition,
+			"offset":    result.Offset,
+		}).Debug("Outbox message published")
+	}
+
+	return results, nil
+}
+
+// deliverOutbox публикует запись outbox вместе с предшествующими неотправленными
+// записями того же ключа и ждёт подтверждения Kafka. Записи блокируются FOR UPDATE,
+// поэтому OutboxRelay не отправит их повторно.
+func (p *Producer) deliverOutbox(ctx context.Context, key string, id int64) (*DeliveryResult, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT `+selectOutboxColumns+`
+		FROM insurance.outbox
+		WHERE message_key = $1 AND id <= $2 AND sent_at IS NULL
+		ORDER BY id
+		FOR UPDATE`,
+		key, id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select outbox messages: %w", err)
+	}
+	messages, err := scanOutboxMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	results, publishErr := publishOutbox(ctx, tx, p, messages, p.logger)
+	// Коммитим даже при ошибке публикации: отправленные записи и счётчик попыток должны сохраниться
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit outbox transaction: %w", err)
+	}
+	if publishErr != nil {
+		return nil, publishErr
+	}
+
+	if result, ok := results[id]; ok {
+		return result, nil
+	}
+
+	// Запись уже опубликовал OutboxRelay - возвращаем сохранённое подтверждение
+	return p.loadOutboxDelivery(ctx, id)
+}
+
+// deliverOutboxBatch публикует записи outbox ids вместе с предшествующими неотправленными
+// записями тех же ключей в одной транзакции Kafka и отмечает их отправленными.
+// Возвращает подтверждения записей ids, включая уже опубликованные ранее.
+func (p *Producer) deliverOutboxBatch(ctx context.Context, keys []string, ids []int64) (map[int64]*DeliveryResult, error) {
+	var maxID int64
+	for _, id := range ids {
+		if id > maxID {
+			maxID = id
+		}
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT `+selectOutboxColumns+`
+		FROM insurance.outbox
+		WHERE message_key = ANY($1) AND id <= $2 AND sent_at IS NULL
+		ORDER BY id
+		FOR UPDATE`,
+		pq.Array(keys), maxID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select outbox messages: %w", err)
+	}
+	messages, err := scanOutboxMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[int64]*DeliveryResult, len(ids))
+	if len(messages) > 0 {
+		delivered, publishErr := p.publishOutboxTxn(ctx, messages)
+		if publishErr != nil {
+			// Сохраняем счётчик попыток, записи повторит OutboxRelay
+			outboxIDs := make([]int64, len(messages))
+			for i, msg := range messages {
+				outboxIDs[i] = msg.ID
+			}
+			if _, err := tx.ExecContext(ctx, `
+				UPDATE insurance.outbox
+				SET attempts = attempts + 1, last_error = $1
+				WHERE id = ANY($2)`,
+				publishErr.Error(), pq.Array(outboxIDs),
+			); err != nil {
+				return nil, fmt.Errorf("failed to record outbox error: %w", err)
+			}
+			if err := tx.Commit(); err != nil {
+				return nil, fmt.Errorf("failed to commit outbox transaction: %w", err)
+			}
+			return nil, publishErr
+		}
+
+		for i, msg := range messages {
+			result := delivered[i]
+			_, err = tx.ExecContext(ctx, `
+				UPDATE insurance.outbox
+				SET sent_at = NOW(), kafka_partition = $1, kafka_offset = $2, attempts = attempts + 1, last_error = NULL
+				WHERE id = $3`,
+				result.Partition, result.Offset, msg.ID,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("failed to mark outbox message as sent: %w", err)
+			}
+			results[msg.ID] = result
+		}
+
+		// Если отметка не сохранится, OutboxRelay опубликует записи повторно с теми же
+		// event_id, и консьюмеры отсекут дубликаты
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("failed to commit outbox transaction: %w", err)
+		}
+	}
+
+	// Записи, которые уже опубликовал OutboxRelay
+	for _, id := range ids {
+		if _, ok := results[id]; ok {
+			continue
+		}
+		result, err := p.loadOutboxDelivery(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		results[id] = result
+	}
+
+	return results, nil
+}
+
+// publishOutboxTxn публикует записи outbox в одной транзакции Kafka
+func (p *Producer) publishOutboxTxn(ctx context.Context, messages []*outboxMessage) ([]*DeliveryResult, error) {
+	p.txnMu.Lock()
+	defer p.txnMu.Unlock()
+
+	producerMessages := make([]*sarama.ProducerMessage, len(messages))
+	for i, msg := range messages {
+		producerMessages[i] = msg.toProducerMessage()
+	}
+
+	if err := p.txnProducer.BeginTxn(); err != nil {
+		return nil, fmt.Errorf("failed to begin kafka transaction: %w", err)
+	}
+
+	results, err := p.send(ctx, p.txnProducer, producerMessages...)
+	if err != nil {
+		p.abortTxn()
+		return nil, fmt.Errorf("failed to publish batch: %w", err)
+	}
+
+	if err := p.txnProducer.CommitTxn(); err != nil {
+		p.abortTxn()
+		return nil, fmt.Errorf("failed to commit kafka transaction: %w", err)
+	}
+	return results, nil
+}
+
+// storedOutboxMessage проверяет, сохранено ли событие раньше (идемпотентность), и возвращает
+// id и ключ его записи outbox. found - событие уже есть в policy_events. Событие без записи
+// outbox (сохранённое до её появления) OutboxRelay не доставит, поэтому это ошибка, а не
+// ErrDeliveryPending.
+func storedOutboxMessage(ctx context.Context, tx *sql.Tx, eventID string) (id int64, key string, found bool, err error) {
+	var outboxID sql.NullInt64
+	var messageKey sql.NullString
+	err = tx.QueryRowContext(ctx, `
+		SELECT o.id, o.message_key
+		FROM insurance.policy_events e
+		LEFT JOIN insurance.outbox o ON o.event_id = e.id
+		WHERE e.id = $1`,
+		eventID,
+	).Scan(&outboxID, &messageKey)
+	if err == sql.ErrNoRows {
+		return 0, "", false, nil
+	}
+	if err != nil {
+		return 0, "", false, fmt.Errorf("failed to check existing event: %w", err)
+	}
+	if !outboxID.Valid {
+		return 0, "", true, fmt.Errorf("event %s is stored without outbox message and cannot be redelivered", eventID)
+	}
+	return outboxID.Int64, messageKey.String, true, nil
+}
+
+// loadOutboxDelivery возвращает сохранённое подтверждение отправленной записи outbox
+func (p *Producer) loadOutboxDelivery(ctx context.Context, id int64) (*DeliveryResult, error) {
+	result := &DeliveryResult{}
+	err := p.db.QueryRowContext(ctx,
+		"SELECT topic, kafka_partition, kafka_offset FROM insurance.outbox WHERE id = $1 AND sent_at IS NOT NULL",
+		id,
+	).Scan(&result.Topic, &result.Partition, &result.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load outbox delivery: %w", err)
+	}
+	return result, nil
+}
+
+// OutboxRelay публикует в Kafka сообщения из таблицы insurance.outbox,
+// которые не удалось доставить сразу
+type OutboxRelay struct {
+	producer     *Producer
+	db           *sql.DB
+	logger       *logrus.Logger
+	pollInterval time.Duration
+	batchSize    int
+}
+
+// NewOutboxRelay создаёт новый ретранслятор outbox
+func NewOutboxRelay(producer *Producer, db *sql.DB, logger *logrus.Logger) *OutboxRelay {
+	return &OutboxRelay{
+		producer:     producer,
+		db:           db,
+		logger:       logger,
+		pollInterval: 500 * time.Millisecond,
+		batchSize:    100,
+	}
+}
+
+// Run периодически публикует неотправленные сообщения до отмены контекста
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Вычитываем outbox пачками, пока есть полные пачки
+		for {
+			sent, err := r.relayBatch(ctx)
+			if err != nil {
+				r.logger.WithError(err).Error("Failed to relay outbox batch")
+				break
+			}
+			if sent < r.batchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			r.logger.Info("Outbox relay stopped")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayBatch публикует очередную пачку сообщений в порядке их записи
+func (r *OutboxRelay) relayBatch(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Если outbox уже обрабатывает другой экземпляр, пропускаем этот тик
+	var locked bool
+	if err := tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock($1)", outboxRelayLockID).Scan(&locked); err != nil {
+		return 0, fmt.Errorf("failed to acquire outbox lock: %w", err)
+	}
+	if !locked {
+		return 0, nil
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT `+selectOutboxColumns+`
+		FROM insurance.outbox
+		WHERE sent_at IS NULL
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE`,
+		r.batchSize,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to select outbox messages: %w", err)
+	}
+	messages, err := scanOutboxMessages(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	results, publishErr := publishOutbox(ctx, tx, r.producer, messages, r.logger)
+	sent := len(results)
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit outbox transaction: %w", err)
+	}
+
+	if sent > 0 {
+		r.logger.WithField("count", sent).Info("Outbox messages published")
+	}
+
+	// Неотправленные записи остаются в outbox и будут повторены на следующем тике
+	if publishErr != nil {
+		return sent, publishErr
+	}
+
+	return sent, nil
+}
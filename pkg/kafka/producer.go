@@ -4,7 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
@@ -14,10 +16,12 @@ import (
 
 // Producer представляет Kafka продюсер с exactly-once гарантиями
 type Producer struct {
-	producer sarama.AsyncProducer
-	db       *sql.DB
-	logger   *logrus.Logger
-	config   *Config
+	producer    sarama.AsyncProducer
+	txnProducer sarama.AsyncProducer
+	txnMu       sync.Mutex // Транзакции Kafka у продюсера последовательные
+	db          *sql.DB
+	logger      *logrus.Logger
+	config      *Config
 }
 
 // PolicyEvent представляет событие страхового полиса
@@ -31,31 +35,83 @@ type PolicyEvent struct {
 	Version   string                 `json:"version"`
 }
 
-// NewProducer создаёт новый продюсер
+// DeliveryResult содержит подтверждение Kafka для опубликованного сообщения
+type DeliveryResult struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// ErrDeliveryPending возвращается, когда событие сохранено в outbox, но не доставлено
+// в Kafka: его доставит OutboxRelay, повторно публиковать событие не нужно
+var ErrDeliveryPending = errors.New("kafka: event stored in outbox, delivery pending")
+
+// pendingDelivery связывает отправленное сообщение с его подтверждением через ProducerMessage.Metadata
+type pendingDelivery struct {
+	done chan error
+}
+
+// NewProducer создаёт новый продюсер с настройками по умолчанию
 func NewProducer(brokers []string, db *sql.DB, logger *logrus.Logger) (*Producer, error) {
-	config := NewProducerConfig()
+	cfg := DefaultConfig()
+	cfg.Brokers = brokers
+	return NewProducerFromConfig(cfg, db, logger)
+}
 
-	producer, err := sarama.NewAsyncProducer(brokers, config)
+// NewProducerFromConfig создаёт новый продюсер по конфигурации
+func NewProducerFromConfig(cfg *Config, db *sql.DB, logger *logrus.Logger) (*Producer, error) {
+	producerConfig, err := cfg.ProducerConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// Одиночные сообщения публикуются вне транзакций Kafka:
+	// идемпотентности и подтверждения от всех реплик достаточно
+	producer, err := sarama.NewAsyncProducer(cfg.Brokers, producerConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create producer: %w", err)
 	}
 
+	// Пакеты публикуются в транзакциях Kafka с постоянным transactional.id экземпляра
+	transactionalID := cfg.TransactionalID
+	if transactionalID == "" {
+		transactionalID = NewTransactionalID("")
+	}
+	txnConfig, err := cfg.TransactionalProducerConfig(transactionalID)
+	if err != nil {
+		producer.Close()
+		return nil, err
+	}
+	txnProducer, err := sarama.NewAsyncProducer(cfg.Brokers, txnConfig)
+	if err != nil {
+		producer.Close()
+		return nil, fmt.Errorf("failed to create transactional producer: %w", err)
+	}
+
 	p := &Producer{
-		producer: producer,
-		db:       db,
-		logger:   logger,
-		config:   DefaultConfig(),
+		producer:    producer,
+		txnProducer: txnProducer,
+		db:          db,
+		logger:      logger,
+		config:      cfg,
 	}
 
 	// Запускаем горутины для обработки результатов
-	go p.handleSuccesses()
-	go p.handleErrors()
+	go p.handleSuccesses(producer)
+	go p.handleErrors(producer)
+	go p.handleSuccesses(txnProducer)
+	go p.handleErrors(txnProducer)
+
+	logger.WithField("transactional_id", transactionalID).Info("Kafka producer created")
 
 	return p, nil
 }
 
-// PublishPolicyEvent публикует событие полиса с exactly-once гарантиями
-func (p *Producer) PublishPolicyEvent(ctx context.Context, event *PolicyEvent) error {
+// PublishPolicyEvent сохраняет событие полиса и сообщение для Kafka в одной транзакции,
+// затем публикует его и ждёт подтверждения от Kafka или истечения контекста.
+// При ошибке публикации событие остаётся в outbox и будет доставлено OutboxRelay,
+// а ошибка соответствует ErrDeliveryPending.
+func (p *Producer) PublishPolicyEvent(ctx context.Context, event *PolicyEvent) (*DeliveryResult, error) {
 	// Генерируем уникальный ID для события если не задан
 	if event.ID == "" {
 		event.ID = uuid.New().String()
@@ -69,66 +125,32 @@ func (p *Producer) PublishPolicyEvent(ctx context.Context, event *PolicyEvent) e
 	// Начинаем транзакцию в PostgreSQL
 	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback() // Откатываем если не закоммитили
 
 	// Проверяем, не обрабатывали ли мы уже это событие (идемпотентность)
-	var existingID string
-	err = tx.QueryRowContext(ctx,
-		"SELECT id FROM insurance.policy_events WHERE id = $1",
-		event.ID,
-	).Scan(&existingID)
-
-	if err == nil {
-		// Событие уже существует, возвращаем успех (идемпотентность)
+	existingID, existingKey, found, err := storedOutboxMessage(ctx, tx, event.ID)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		// Событие уже существует - дожидаемся публикации его записи outbox
 		p.logger.WithField("event_id", event.ID).Info("Event already processed, skipping")
-		return nil
-	} else if err != sql.ErrNoRows {
-		return fmt.Errorf("failed to check existing event: %w", err)
+		tx.Rollback()
+		result, err := p.deliverOutbox(ctx, existingKey, existingID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: event %s: %w", ErrDeliveryPending, event.ID, err)
+		}
+		return result, nil
 	}
 
 	// Сериализуем событие
 	eventBytes, err := json.Marshal(event)
 	if err != nil {
-		return fmt.Errorf("failed to marshal event: %w", err)
+		return nil, fmt.Errorf("failed to marshal event: %w", err)
 	}
 
-	// Создаём Kafka сообщение
-	message := &sarama.ProducerMessage{
-		Topic: "auto.events",
-		Key:   sarama.StringEncoder(event.PolicyID), // Партиционируем по policy_id
-		Value: sarama.ByteEncoder(eventBytes),
-		Headers: []sarama.RecordHeader{
-			{
-				Key:   []byte("event_id"),
-				Value: []byte(event.ID),
-			},
-			{
-				Key:   []byte("event_type"),
-				Value: []byte(event.EventType),
-			},
-			{
-				Key:   []byte("source"),
-				Value: []byte(event.Source),
-			},
-		},
-		Timestamp: event.Timestamp,
-	}
-
-	// Отправляем сообщение в Kafka (асинхронно)
-	select {
-	case p.producer.Input() <- message:
-		// Сообщение отправлено в очередь
-	case <-ctx.Done():
-		return ctx.Err()
-	}
-
-	// Ждём подтверждения от Kafka перед коммитом транзакции
-	// В реальной системе здесь нужно более сложная логика синхронизации
-	// Для упрощения используем небольшую задержку
-	time.Sleep(100 * time.Millisecond)
-
 	// Записываем событие в базу данных
 	eventDataJSON, _ := json.Marshal(event.EventData)
 	_, err = tx.ExecContext(ctx, `
@@ -140,39 +162,69 @@ func (p *Producer) PublishPolicyEvent(ctx context.Context, event *PolicyEvent) e
 	)
 
 	if err != nil {
-		return fmt.Errorf("failed to insert event: %w", err)
+		return nil, fmt.Errorf("failed to insert event: %w", err)
+	}
+
+	// Кладём сообщение в outbox в той же транзакции
+	outboxID, err := writeOutbox(ctx, tx, &outboxMessage{
+		EventID: event.ID,
+		Topic:   "auto.events",
+		Key:     event.PolicyID, // Партиционируем по policy_id
+		Payload: eventBytes,
+		Headers: map[string]string{
+			"event_id":   event.ID,
+			"event_type": event.EventType,
+			"source":     event.Source,
+		},
+		Timestamp: event.Timestamp,
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// Коммитим транзакцию
 	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	// Публикуем сообщение и ждём подтверждения от Kafka
+	result, err := p.deliverOutbox(ctx, event.PolicyID, outboxID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: event %s: %w", ErrDeliveryPending, event.ID, err)
 	}
 
 	p.logger.WithFields(logrus.Fields{
 		"event_id":   event.ID,
 		"policy_id":  event.PolicyID,
 		"event_type": event.EventType,
+		"partition":  result.Partition,
+		"offset":     result.Offset,
 	}).Info("Policy event published successfully")
 
-	return nil
+	return result, nil
 }
 
-// PublishPolicyEventBatch публикует пакет событий атомарно
-func (p *Producer) PublishPolicyEventBatch(ctx context.Context, events []*PolicyEvent) error {
+// PublishPolicyEventBatch сохраняет пакет событий и их сообщения outbox в одной транзакции
+// PostgreSQL, затем публикует их в одной транзакции Kafka: консьюмеры с read_committed
+// видят либо весь пакет, либо ничего. Kafka коммитится только после PostgreSQL, поэтому
+// в Kafka не попадают события, которых нет в базе. Если публикация не удалась, события
+// остаются в outbox и будут доставлены OutboxRelay, а ошибка соответствует ErrDeliveryPending. Результаты возвращаются в порядке events.
+func (p *Producer) PublishPolicyEventBatch(ctx context.Context, events []*PolicyEvent) ([]*DeliveryResult, error) {
 	if len(events) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	// Начинаем транзакцию
 	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	var messages []*sarama.ProducerMessage
+	outboxIDs := make([]int64, len(events))
+	var keys []string
 
-	for _, event := range events {
+	for i, event := range events {
 		// Генерируем ID если не задан
 		if event.ID == "" {
 			event.ID = uuid.New().String()
@@ -182,39 +234,23 @@ func (p *Producer) PublishPolicyEventBatch(ctx context.Context, events []*Policy
 			event.Timestamp = time.Now()
 		}
 
-		// Проверяем идемпотентность
-		var existingID string
-		err = tx.QueryRowContext(ctx,
-			"SELECT id FROM insurance.policy_events WHERE id = $1",
-			event.ID,
-		).Scan(&existingID)
-
-		if err == nil {
-			continue // Событие уже существует
-		} else if err != sql.ErrNoRows {
-			return fmt.Errorf("failed to check existing event: %w", err)
+		// Событие уже сохранено (идемпотентность) - дожидаемся публикации его записи outbox
+		outboxID, key, found, err := storedOutboxMessage(ctx, tx, event.ID)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			outboxIDs[i] = outboxID
+			keys = append(keys, key)
+			continue
 		}
 
 		// Сериализуем событие
 		eventBytes, err := json.Marshal(event)
 		if err != nil {
-			return fmt.Errorf("failed to marshal event: %w", err)
-		}
-
-		// Создаём Kafka сообщение
-		message := &sarama.ProducerMessage{
-			Topic: "auto.events",
-			Key:   sarama.StringEncoder(event.PolicyID),
-			Value: sarama.ByteEncoder(eventBytes),
-			Headers: []sarama.RecordHeader{
-				{Key: []byte("event_id"), Value: []byte(event.ID)},
-				{Key: []byte("event_type"), Value: []byte(event.EventType)},
-			},
-			Timestamp: event.Timestamp,
+			return nil, fmt.Errorf("failed to marshal event: %w", err)
 		}
 
-		messages = append(messages, message)
-
 		// Записываем в базу
 		eventDataJSON, _ := json.Marshal(event.EventData)
 		_, err = tx.ExecContext(ctx, `
@@ -226,55 +262,128 @@ func (p *Producer) PublishPolicyEventBatch(ctx context.Context, events []*Policy
 		)
 
 		if err != nil {
-			return fmt.Errorf("failed to insert event: %w", err)
+			return nil, fmt.Errorf("failed to insert event: %w", err)
 		}
-	}
 
-	// Отправляем все сообщения в Kafka
-	for _, message := range messages {
-		select {
-		case p.producer.Input() <- message:
-			// Сообщение отправлено
-		case <-ctx.Done():
-			return ctx.Err()
+		// Кладём сообщение в outbox в той же транзакции
+		outboxIDs[i], err = writeOutbox(ctx, tx, &outboxMessage{
+			EventID: event.ID,
+			Topic:   "auto.events",
+			Key:     event.PolicyID,
+			Payload: eventBytes,
+			Headers: map[string]string{
+				"event_id":   event.ID,
+				"event_type": event.EventType,
+				"source":     event.Source,
+			},
+			Timestamp: event.Timestamp,
+		})
+		if err != nil {
+			return nil, err
 		}
+		keys = append(keys, event.PolicyID)
 	}
 
-	// Ждём подтверждения
-	time.Sleep(time.Duration(len(messages)) * 50 * time.Millisecond)
-
 	// Коммитим транзакцию
 	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	// Публикуем пакет в транзакции Kafka и ждём подтверждения
+	delivered, err := p.deliverOutboxBatch(ctx, keys, outboxIDs)
+	if err != nil {
+		return nil, fmt.Errorf("%w: event batch: %w", ErrDeliveryPending, err)
+	}
+
+	results := make([]*DeliveryResult, len(events))
+	for i, id := range outboxIDs {
+		results[i] = delivered[id]
 	}
 
 	p.logger.WithField("batch_size", len(events)).Info("Policy event batch published successfully")
-	return nil
+	return results, nil
+}
+
+// abortTxn прерывает текущую транзакцию Kafka
+func (p *Producer) abortTxn() {
+	if err := p.txnProducer.AbortTxn(); err != nil {
+		p.logger.WithError(err).Error("Failed to abort kafka transaction")
+	}
+}
+
+// send отправляет сообщения через указанный продюсер и блокируется, пока Kafka
+// не подтвердит каждое из них или не истечёт контекст
+func (p *Producer) send(ctx context.Context, producer sarama.AsyncProducer, messages ...*sarama.ProducerMessage) ([]*DeliveryResult, error) {
+	pending := make([]*pendingDelivery, len(messages))
+	for i, message := range messages {
+		// Буфер на одно значение: обработчики результатов не блокируются,
+		// даже если вызывающий уже перестал ждать
+		pending[i] = &pendingDelivery{done: make(chan error, 1)}
+		message.Metadata = pending[i]
+
+		select {
+		case producer.Input() <- message:
+			// Сообщение отправлено в очередь
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	results := make([]*DeliveryResult, len(messages))
+	for i, message := range messages {
+		select {
+		case err := <-pending[i].done:
+			if err != nil {
+				return nil, fmt.Errorf("failed to deliver message to %s: %w", message.Topic, err)
+			}
+			results[i] = &DeliveryResult{
+				Topic:     message.Topic,
+				Partition: message.Partition,
+				Offset:    message.Offset,
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return results, nil
 }
 
 // handleSuccesses обрабатывает успешные отправки
-func (p *Producer) handleSuccesses() {
-	for success := range p.producer.Successes() {
+func (p *Producer) handleSuccesses(producer sarama.AsyncProducer) {
+	for success := range producer.Successes() {
 		p.logger.WithFields(logrus.Fields{
 			"topic":     success.Topic,
 			"partition": success.Partition,
 			"offset":    success.Offset,
 		}).Debug("Message sent successfully")
+
+		if delivery, ok := success.Metadata.(*pendingDelivery); ok {
+			delivery.done <- nil
+		}
 	}
 }
 
 // handleErrors обрабатывает ошибки отправки
-func (p *Producer) handleErrors() {
-	for err := range p.producer.Errors() {
+func (p *Producer) handleErrors(producer sarama.AsyncProducer) {
+	for err := range producer.Errors() {
 		p.logger.WithError(err.Err).WithFields(logrus.Fields{
 			"topic":     err.Msg.Topic,
 			"partition": err.Msg.Partition,
 		}).Error("Failed to send message")
+
+		if delivery, ok := err.Msg.Metadata.(*pendingDelivery); ok {
+			delivery.done <- err.Err
+		}
 	}
 }
 
 // Close закрывает продюсер
 func (p *Producer) Close() error {
+	if err := p.txnProducer.Close(); err != nil {
+		p.producer.Close()
+		return fmt.Errorf("failed to close transactional producer: %w", err)
+	}
 	if err := p.producer.Close(); err != nil {
 		return fmt.Errorf("failed to close producer: %w", err)
 	}
@@ -0,0 +1,97 @@
+package kafka
+
+import (
+	"context"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+)
+
+// Assignment — партиции, назначенные консьюмеру в сессии консьюмер-группы
+type Assignment struct {
+	// Claims — назначенные партиции по топикам
+	Claims       map[string][]int32
+	MemberID     string
+	GenerationID int32
+
+	session sarama.ConsumerGroupSession
+}
+
+// Seek задаёт offset, с которого будет прочитана партиция, например из внешнего
+// хранилища. Действует только в OnPartitionsAssigned, до начала чтения партиции.
+func (a *Assignment) Seek(topic string, partition int32, offset int64) {
+	seek(a.session, topic, partition, offset)
+}
+
+// MarkOffset отмечает offset партиции обработанным: он будет закоммичен при завершении
+// сессии. Нужен в OnPartitionsRevoked, чтобы закоммитить сброшенные буферы.
+func (a *Assignment) MarkOffset(topic string, partition int32, offset int64) {
+	a.session.MarkOffset(topic, partition, offset, "")
+}
+
+// AssignmentHook вызывается при назначении или отзыве партиций
+type AssignmentHook func(ctx context.Context, assignment *Assignment) error
+
+// OnPartitionsAssigned добавляет хук, который вызывается после назначения партиций
+// и до начала их чтения. Ошибка хука завершает сессию, и Start возвращает её.
+func (c *Consumer) OnPartitionsAssigned(hook AssignmentHook) {
+	c.assignedHooks = append(c.assignedHooks, hook)
+}
+
+// OnPartitionsRevoked добавляет хук, который вызывается при завершении сессии
+// (ребалансировка, остановка), когда обработка партиций уже завершена и offset'ы
+// ещё не закоммичены. Ошибки хуков логируются.
+func (c *Consumer) OnPartitionsRevoked(hook AssignmentHook) {
+	c.revokedHooks = append(c.revokedHooks, hook)
+}
+
+// newAssignment описывает назначение партиций сессии
+func newAssignment(session sarama.ConsumerGroupSession) *Assignment {
+	return &Assignment{
+		Claims:       session.Claims(),
+		MemberID:     session.MemberID(),
+		GenerationID: session.GenerationID(),
+		session:      session,
+	}
+}
+
+// partitionsAssigned вызывает хуки назначения и учитывает завершённую ребалансировку
+func (c *Consumer) partitionsAssigned(session sarama.ConsumerGroupSession) error {
+	assignment := newAssignment(session)
+	for _, hook := range c.assignedHooks {
+		if err := hook(session.Context(), assignment); err != nil {
+			return err
+		}
+	}
+
+	// Ребалансировка длится от завершения прошлой сессии (или входа в группу) до назначения
+	c.metrics.Rebalances.WithLabelValues(c.config.GroupID).Inc()
+	if !c.rebalanceStarted.IsZero() {
+		c.metrics.RebalanceDuration.WithLabelValues(c.config.GroupID).Observe(time.Since(c.rebalanceStarted).Seconds())
+	}
+	return nil
+}
+
+// partitionsRevoked вызывает хуки отзыва и отмечает начало ребалансировки
+func (c *Consumer) partitionsRevoked(session sarama.ConsumerGroupSession) {
+	c.rebalanceStarted = time.Now()
+
+	assignment := newAssignment(session)
+	for _, hook := range c.revokedHooks {
+		// Контекст сессии уже отменён, хукам нужен свой
+		if err := hook(context.Background(), assignment); err != nil {
+			c.logger.WithError(err).WithFields(logrus.Fields{
+				"member_id":  assignment.MemberID,
+				"generation": assignment.GenerationID,
+			}).Error("Partitions revoked hook failed")
+		}
+	}
+}
+
+// seek задаёт offset партиции в обе стороны: ResetOffset сдвигает его только назад,
+// MarkOffset - только вперёд
+func seek(session sarama.ConsumerGroupSession, topic string, partition int32, offset int64) {
+	session.ResetOffset(topic, partition, offset, "")
+	session.MarkOffset(topic, partition, offset, "")
+}
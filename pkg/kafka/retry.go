@@ -0,0 +1,186 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+)
+
+// Заголовки сообщений в топиках отложенных повторов
+const (
+	retryAfterHeader     = "retry-after"              // Время, раньше которого сообщение не обрабатывается (RFC 3339)
+	retryTopicHeader     = "retry-original-topic"     // Топик, из которого сообщение прочитано впервые
+	retryPartitionHeader = "retry-original-partition" // Партиция исходного топика
+	retryOffsetHeader    = "retry-original-offset"    // Offset в исходном топике
+	retryGroupHeader     = "retry-consumer-group"     // Консьюмер-группа, которой нужен повтор
+	retryErrorHeader     = "retry-error"              // Ошибка последней попытки
+	retryAttemptHeader   = "retry-attempt"            // Номер уровня повторов, начиная с 1
+)
+
+// errNotParked возвращается, если сообщение некуда отложить: нет ни уровней повторов, ни DLQ
+var errNotParked = errors.New("kafka: no retry topic or DLQ configured")
+
+// RetryTier описывает уровень отложенных повторов: сообщение из топика Topic
+// обрабатывается повторно не раньше, чем через Delay после неудачной попытки
+type RetryTier struct {
+	Topic string        `yaml:"topic"`
+	Delay time.Duration `yaml:"delay"`
+}
+
+// DefaultRetryTiers возвращает уровни повторов через 1 минуту, 10 минут и 1 час.
+// Топики уровней общие для всех консьюмер-групп топика: каждая группа обрабатывает
+// только свои повторы по заголовку retry-consumer-group.
+func DefaultRetryTiers(topic string) []RetryTier {
+	return []RetryTier{
+		{Topic: topic + ".retry.1m", Delay: time.Minute},
+		{Topic: topic + ".retry.10m", Delay: time.Minute * 10},
+		{Topic: topic + ".retry.1h", Delay: time.Hour},
+	}
+}
+
+// retryTierIndex возвращает номер уровня повторов топика или -1 для основного топика
+func (c *Consumer) retryTierIndex(topic string) int {
+	for i, tier := range c.config.RetryTiers {
+		if tier.Topic == topic {
+			return i
+		}
+	}
+	return -1
+}
+
+// isForeignRetry проверяет, что сообщение - повтор для другой консьюмер-группы
+func (c *Consumer) isForeignRetry(message *sarama.ConsumerMessage) bool {
+	return c.retryTierIndex(message.Topic) >= 0 && headerValue(message, retryGroupHeader) != c.config.GroupID
+}
+
+// originalTopic возвращает топик, из которого сообщение было прочитано впервые
+func originalTopic(message *sarama.ConsumerMessage) string {
+	if topic := headerValue(message, retryTopicHeader); topic != "" {
+		return topic
+	}
+	return message.Topic
+}
+
+// originalPosition возвращает партицию и offset сообщения в топике, из которого оно
+// было прочитано впервые
+func originalPosition(message *sarama.ConsumerMessage) (int32, int64) {
+	partition, perr := strconv.ParseInt(headerValue(message, retryPartitionHeader), 10, 32)
+	offset, oerr := strconv.ParseInt(headerValue(message, retryOffsetHeader), 10, 64)
+	if perr != nil || oerr != nil {
+		return message.Partition, message.Offset
+	}
+	return int32(partition), offset
+}
+
+// waitRetryDue блокирует чтение уровня повторов, пока не наступит время retry-after.
+// Задержка у всех сообщений уровня одинаковая, поэтому они созревают по порядку.
+// Возвращает false, если сессия завершилась раньше.
+func (c *Consumer) waitRetryDue(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage) bool {
+	if c.retryTierIndex(message.Topic) < 0 || c.isForeignRetry(message) {
+		return true
+	}
+
+	retryAfter, err := time.Parse(time.RFC3339Nano, headerValue(message, retryAfterHeader))
+	if err != nil {
+		// Без корректного retry-after обрабатываем сразу
+		return true
+	}
+
+	wait := time.Until(retryAfter)
+	if wait <= 0 {
+		return true
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"topic":       message.Topic,
+		"partition":   message.Partition,
+		"offset":      message.Offset,
+		"retry_after": retryAfter,
+	}).Debug("Waiting for retry delay")
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-c.stopping:
+		return false
+	case <-session.Context().Done():
+		return false
+	}
+}
+
+// retryDeliveries возвращает число доставок сообщения до текущего уровня повторов
+func retryDeliveries(message *sarama.ConsumerMessage) int {
+	deliveries, err := strconv.Atoi(headerValue(message, retryAttemptHeader))
+	if err != nil {
+		return 0
+	}
+	return deliveries
+}
+
+// park откладывает необработанное сообщение на следующий уровень повторов,
+// а после последнего уровня или при постоянной ошибке - в DLQ
+func (c *Consumer) park(message *sarama.ConsumerMessage, processingErr error, attempts int) error {
+	if tier := c.retryTierIndex(message.Topic) + 1; tier < len(c.config.RetryTiers) && !IsPermanent(processingErr) {
+		return c.sendToRetry(message, tier, processingErr)
+	}
+
+	if c.config.DLQTopic != "" {
+		return c.sendToDLQ(message, processingErr, attempts+retryDeliveries(message))
+	}
+
+	return errNotParked
+}
+
+// sendToRetry отправляет сообщение в топик уровня повторов tier
+func (c *Consumer) sendToRetry(message *sarama.ConsumerMessage, tier int, processingErr error) error {
+	retryTier := c.config.RetryTiers[tier]
+	retryAfter := time.Now().Add(retryTier.Delay)
+
+	headers := make([]sarama.RecordHeader, 0, len(message.Headers)+7)
+	for _, header := range message.Headers {
+		switch string(header.Key) {
+		case retryAfterHeader, retryTopicHeader, retryPartitionHeader, retryOffsetHeader, retryGroupHeader, retryErrorHeader, retryAttemptHeader:
+			continue
+		}
+		headers = append(headers, *header)
+	}
+	partition, offset := originalPosition(message)
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte(retryAfterHeader), Value: []byte(retryAfter.Format(time.RFC3339Nano))},
+		sarama.RecordHeader{Key: []byte(retryTopicHeader), Value: []byte(originalTopic(message))},
+		sarama.RecordHeader{Key: []byte(retryPartitionHeader), Value: []byte(strconv.Itoa(int(partition)))},
+		sarama.RecordHeader{Key: []byte(retryOffsetHeader), Value: []byte(strconv.FormatInt(offset, 10))},
+		sarama.RecordHeader{Key: []byte(retryGroupHeader), Value: []byte(c.config.GroupID)},
+		sarama.RecordHeader{Key: []byte(retryErrorHeader), Value: []byte(processingErr.Error())},
+		sarama.RecordHeader{Key: []byte(retryAttemptHeader), Value: []byte(fmt.Sprint(tier + 1))},
+	)
+
+	_, _, err := c.producer.SendMessage(&sarama.ProducerMessage{
+		Topic:     retryTier.Topic,
+		Key:       sarama.ByteEncoder(message.Key),
+		Value:     sarama.ByteEncoder(message.Value),
+		Headers:   headers,
+		Timestamp: message.Timestamp,
+	})
+	if err != nil {
+		c.logger.WithError(err).WithField("retry_topic", retryTier.Topic).Error("Failed to send message to retry topic")
+		return fmt.Errorf("failed to send message to retry topic: %w", err)
+	}
+
+	c.metrics.Retries.WithLabelValues(c.metrics.labels(message)...).Inc()
+	c.logger.WithFields(logrus.Fields{
+		"retry_topic":    retryTier.Topic,
+		"original_topic": originalTopic(message),
+		"offset":         message.Offset,
+		"retry_after":    retryAfter,
+	}).Warn("Message sent to retry topic")
+
+	return nil
+}
@@ -0,0 +1,214 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// EventHandlerFunc обрабатывает событие полиса одного типа
+type EventHandlerFunc func(ctx context.Context, event *PolicyEvent) error
+
+// BatchEventHandlerFunc обрабатывает подряд идущие события пакета, см. Router.OnBatch
+type BatchEventHandlerFunc func(ctx context.Context, events []*PolicyEvent) error
+
+// batchRoute — пакетный обработчик, зарегистрированный для одного или нескольких типов событий
+type batchRoute struct {
+	handler BatchEventHandlerFunc
+}
+
+// UnknownEventPolicy определяет, что Router делает с событием незарегистрированного типа
+type UnknownEventPolicy string
+
+const (
+	// UnknownEventSkip пропускает событие с предупреждением в логе
+	UnknownEventSkip UnknownEventPolicy = "skip"
+	// UnknownEventFail возвращает постоянную ошибку: событие уходит в DLQ
+	UnknownEventFail UnknownEventPolicy = "fail"
+)
+
+// unknownEventLabel — значение метки event_type для незарегистрированных типов,
+// чтобы произвольные типы не раздували число временных рядов
+const unknownEventLabel = "unknown"
+
+// Router реализует MessageHandler: декодирует PolicyEvent один раз
+// и передаёт его обработчику, зарегистрированному для типа события
+type Router struct {
+	topic         string
+	handlers      map[string]EventHandlerFunc
+	batchHandlers map[string]*batchRoute
+	unknownPolicy UnknownEventPolicy
+	logger        *logrus.Logger
+	events        *prometheus.CounterVec
+	duration      prometheus.ObserverVec
+}
+
+// NewRouter создаёт новый Router для топика. По умолчанию события неизвестных типов пропускаются.
+// Метрики регистрируются в registerer, nil - prometheus.DefaultRegisterer.
+func NewRouter(topic string, registerer prometheus.Registerer, logger *logrus.Logger) *Router {
+	return &Router{
+		topic:         topic,
+		handlers:      make(map[string]EventHandlerFunc),
+		batchHandlers: make(map[string]*batchRoute),
+		unknownPolicy: UnknownEventSkip,
+		logger:        logger,
+		events: mustRegisterCounterVec(registerer, prometheus.CounterOpts{
+			Name: "kafka_router_events_total",
+			Help: "Total number of routed events by type and result",
+		}, []string{"topic", "event_type", "result"}).MustCurryWith(prometheus.Labels{"topic": topic}),
+		duration: mustRegisterHistogramVec(registerer, prometheus.HistogramOpts{
+			Name: "kafka_router_event_duration_seconds",
+			Help: "Time spent handling events by type",
+		}, []string{"topic", "event_type"}).MustCurryWith(prometheus.Labels{"topic": topic}),
+	}
+}
+
+// On регистрирует обработчик для типа события
+func (r *Router) On(eventType string, handler EventHandlerFunc) {
+	r.handlers[eventType] = handler
+}
+
+// OnBatch регистрирует пакетный обработчик для типов событий. В RouteBatch подряд идущие
+// события этих типов передаются ему одним вызовом; в Handle по-прежнему работают
+// обработчики On, поэтому для каждого типа нужен и обработчик On.
+func (r *Router) OnBatch(handler BatchEventHandlerFunc, eventTypes ...string) {
+	route := &batchRoute{handler: handler}
+	for _, eventType := range eventTypes {
+		r.batchHandlers[eventType] = route
+	}
+}
+
+// SetUnknownEventPolicy задаёт политику для событий незарегистрированных типов
+func (r *Router) SetUnknownEventPolicy(policy UnknownEventPolicy) {
+	r.unknownPolicy = policy
+}
+
+// Handle реализует интерфейс MessageHandler
+func (r *Router) Handle(ctx context.Context, message *sarama.ConsumerMessage) error {
+	event, err := r.decode(message)
+	if err != nil {
+		return err
+	}
+	return r.route(ctx, event)
+}
+
+// RouteBatch обрабатывает пакет сообщений по порядку: подряд идущие события типов
+// с обработчиком OnBatch передаются ему одним вызовом, остальные - обработчикам On.
+// Метрики и политика неизвестных типов те же, что у Handle. Обработчик MessageHandler
+// реализует BatchHandler, вызывая RouteBatch из HandleBatch.
+func (r *Router) RouteBatch(ctx context.Context, messages []*sarama.ConsumerMessage) error {
+	var (
+		pending []*PolicyEvent
+		route   *batchRoute
+	)
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		err := r.routeBatch(ctx, route, pending)
+		pending, route = nil, nil
+		return err
+	}
+
+	for _, message := range messages {
+		event, err := r.decode(message)
+		if err != nil {
+			return err
+		}
+
+		if next, ok := r.batchHandlers[event.EventType]; ok {
+			if next != route {
+				if err := flush(); err != nil {
+					return err
+				}
+				route = next
+			}
+			pending = append(pending, event)
+			continue
+		}
+
+		// Порядок сохраняется: накопленные события обрабатываются перед остальными
+		if err := flush(); err != nil {
+			return err
+		}
+		if err := r.route(ctx, event); err != nil {
+			return err
+		}
+	}
+
+	return flush()
+}
+
+// decode декодирует событие сообщения
+func (r *Router) decode(message *sarama.ConsumerMessage) (*PolicyEvent, error) {
+	var event PolicyEvent
+	if err := json.Unmarshal(message.Value, &event); err != nil {
+		r.events.WithLabelValues(unknownEventLabel, "invalid").Inc()
+		// Битое сообщение не исправится повтором
+		return nil, Permanent(fmt.Errorf("failed to unmarshal event: %w", err))
+	}
+	return &event, nil
+}
+
+// route передаёт событие обработчику его типа
+func (r *Router) route(ctx context.Context, event *PolicyEvent) error {
+	fields := logrus.Fields{
+		"event_id":   event.ID,
+		"policy_id":  event.PolicyID,
+		"event_type": event.EventType,
+	}
+
+	handler, ok := r.handlers[event.EventType]
+	if !ok {
+		r.events.WithLabelValues(unknownEventLabel, string(r.unknownPolicy)).Inc()
+		if r.unknownPolicy == UnknownEventFail {
+			return Permanent(fmt.Errorf("unknown event type %q", event.EventType))
+		}
+		r.logger.WithFields(fields).Warn("Unknown event type, skipping")
+		return nil
+	}
+
+	r.logger.WithFields(fields).Debug("Routing event")
+
+	start := time.Now()
+	err := handler(ctx, event)
+	r.duration.WithLabelValues(event.EventType).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		r.events.WithLabelValues(event.EventType, "error").Inc()
+		return err
+	}
+
+	r.events.WithLabelValues(event.EventType, "success").Inc()
+	return nil
+}
+
+// routeBatch передаёт события пакетному обработчику. Время обработки делится поровну
+// между событиями, чтобы гистограмма оставалась временем на одно событие.
+func (r *Router) routeBatch(ctx context.Context, route *batchRoute, events []*PolicyEvent) error {
+	r.logger.WithField("events", len(events)).Debug("Routing event batch")
+
+	start := time.Now()
+	err := route.handler(ctx, events)
+	perEvent := time.Since(start).Seconds() / float64(len(events))
+
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	for _, event := range events {
+		r.duration.WithLabelValues(event.EventType).Observe(perEvent)
+		r.events.WithLabelValues(event.EventType, result).Inc()
+	}
+	return err
+}
+
+// GetTopic реализует интерфейс MessageHandler
+func (r *Router) GetTopic() string {
+	return r.topic
+}
@@ -0,0 +1,202 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+// eventMessage собирает сообщение с событием полиса
+func eventMessage(t *testing.T, id, eventType string) *sarama.ConsumerMessage {
+	t.Helper()
+	value, err := json.Marshal(&PolicyEvent{ID: id, PolicyID: "policy-" + id, EventType: eventType})
+	if err != nil {
+		t.Fatalf("marshal event: %v", err)
+	}
+	return &sarama.ConsumerMessage{Topic: "auto.events", Value: value}
+}
+
+// newTestRouter создаёт Router с отдельным реестром метрик
+func newTestRouter() *Router {
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	return NewRouter("auto.events", prometheus.NewRegistry(), logger)
+}
+
+func TestRouterHandle(t *testing.T) {
+	errHandler := errors.New("database is down")
+
+	tests := []struct {
+		name        string
+		value       string // Сырое значение сообщения, пусто - событие eventType
+		eventType   string
+		policy      UnknownEventPolicy
+		wantCalled  bool
+		wantErr     error
+		wantLabel   string
+		wantResult  string
+		wantPermErr bool
+	}{
+		{name: "registered type", eventType: "created", wantCalled: true, wantLabel: "created", wantResult: "success"},
+		{name: "handler error", eventType: "failing", wantCalled: true, wantErr: errHandler, wantLabel: "failing", wantResult: "error"},
+		{name: "unknown type skipped", eventType: "archived", policy: UnknownEventSkip, wantLabel: unknownEventLabel, wantResult: "skip"},
+		{name: "unknown type failed", eventType: "archived", policy: UnknownEventFail, wantLabel: unknownEventLabel, wantResult: "fail", wantPermErr: true},
+		{name: "invalid json", value: "{not json", wantLabel: unknownEventLabel, wantResult: "invalid", wantPermErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newTestRouter()
+			if tt.policy != "" {
+				router.SetUnknownEventPolicy(tt.policy)
+			}
+
+			var called []string
+			router.On("created", func(ctx context.Context, event *PolicyEvent) error {
+				called = append(called, event.ID)
+				return nil
+			})
+			router.On("failing", func(ctx context.Context, event *PolicyEvent) error {
+				called = append(called, event.ID)
+				return errHandler
+			})
+
+			message := eventMessage(t, "1", tt.eventType)
+			if tt.value != "" {
+				message.Value = []byte(tt.value)
+			}
+
+			err := router.Handle(context.Background(), message)
+			switch {
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Errorf("Handle() error = %v, want %v", err, tt.wantErr)
+			case tt.wantPermErr && !IsPermanent(err):
+				t.Errorf("Handle() error = %v, want permanent", err)
+			case tt.wantErr == nil && !tt.wantPermErr && err != nil:
+				t.Errorf("Handle() error = %v, want nil", err)
+			}
+
+			if (len(called) > 0) != tt.wantCalled {
+				t.Errorf("handler called = %v, want %v", called, tt.wantCalled)
+			}
+			if got := testutil.ToFloat64(router.events.WithLabelValues(tt.wantLabel, tt.wantResult)); got != 1 {
+				t.Errorf("events{%s,%s} = %v, want 1", tt.wantLabel, tt.wantResult, got)
+			}
+		})
+	}
+}
+
+func TestRouterRouteBatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []string // Типы событий пакета, ID - порядковый номер
+		want   []string // Вызовы обработчиков по порядку
+	}{
+		{
+			name:   "consecutive batch types are grouped",
+			events: []string{"created", "renewed", "created"},
+			want:   []string{"batch[0 1 2]"},
+		},
+		{
+			name:   "single events keep order",
+			events: []string{"created", "cancelled", "renewed", "renewed"},
+			want:   []string{"batch[0]", "cancelled 1", "batch[2 3]"},
+		},
+		{
+			name:   "no batch types",
+			events: []string{"cancelled", "cancelled"},
+			want:   []string{"cancelled 0", "cancelled 1"},
+		},
+		{
+			name:   "unknown type between batches is skipped",
+			events: []string{"created", "archived", "created"},
+			want:   []string{"batch[0]", "batch[2]"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newTestRouter()
+
+			var calls []string
+			single := func(ctx context.Context, event *PolicyEvent) error {
+				calls = append(calls, event.EventType+" "+event.ID)
+				return nil
+			}
+			router.On("created", single)
+			router.On("renewed", single)
+			router.On("cancelled", single)
+			router.OnBatch(func(ctx context.Context, events []*PolicyEvent) error {
+				ids := make([]string, len(events))
+				for i, event := range events {
+					ids[i] = event.ID
+				}
+				calls = append(calls, "batch["+strings.Join(ids, " ")+"]")
+				return nil
+			}, "created", "renewed")
+
+			messages := make([]*sarama.ConsumerMessage, len(tt.events))
+			for i, eventType := range tt.events {
+				messages[i] = eventMessage(t, string(rune('0'+i)), eventType)
+			}
+
+			if err := router.RouteBatch(context.Background(), messages); err != nil {
+				t.Fatalf("RouteBatch() error = %v", err)
+			}
+			if strings.Join(calls, ", ") != strings.Join(tt.want, ", ") {
+				t.Errorf("calls = %v, want %v", calls, tt.want)
+			}
+
+			// Метрики событий пакета те же, что при обработке по одному
+			counts := make(map[string]int)
+			for _, eventType := range tt.events {
+				if eventType != "archived" {
+					counts[eventType]++
+				}
+			}
+			for eventType, count := range counts {
+				if got := testutil.ToFloat64(router.events.WithLabelValues(eventType, "success")); got != float64(count) {
+					t.Errorf("events{%s,success} = %v, want %d", eventType, got, count)
+				}
+			}
+		})
+	}
+}
+
+func TestRouterRouteBatchError(t *testing.T) {
+	router := newTestRouter()
+	errBatch := errors.New("insert failed")
+
+	var singles int
+	router.On("cancelled", func(ctx context.Context, event *PolicyEvent) error {
+		singles++
+		return nil
+	})
+	router.OnBatch(func(ctx context.Context, events []*PolicyEvent) error {
+		return errBatch
+	}, "created")
+
+	messages := []*sarama.ConsumerMessage{
+		eventMessage(t, "0", "created"),
+		eventMessage(t, "1", "created"),
+		eventMessage(t, "2", "cancelled"),
+	}
+	if err := router.RouteBatch(context.Background(), messages); !errors.Is(err, errBatch) {
+		t.Fatalf("RouteBatch() error = %v, want %v", err, errBatch)
+	}
+
+	// Пакет прерывается на первой ошибке, следующие события не обрабатываются
+	if singles != 0 {
+		t.Errorf("cancelled handled %d times after batch error, want 0", singles)
+	}
+	if got := testutil.ToFloat64(router.events.WithLabelValues("created", "error")); got != 2 {
+		t.Errorf("events{created,error} = %v, want 2", got)
+	}
+}
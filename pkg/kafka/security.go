@@ -0,0 +1,170 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// Механизмы SASL
+const (
+	SASLMechanismPlain       = "PLAIN"
+	SASLMechanismSCRAMSHA256 = "SCRAM-SHA-256"
+	SASLMechanismSCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+// TLSSettings содержит настройки TLS подключения к брокерам. TLS включается флагом Enabled
+// или заданным CAFile/CertFile.
+type TLSSettings struct {
+	Enabled bool `yaml:"enabled"`
+	// CAFile — PEM с CA, которым подписаны сертификаты брокеров, пусто - системные CA
+	CAFile string `yaml:"ca_file"`
+	// CertFile и KeyFile — клиентский сертификат и ключ в PEM для mTLS
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ServerName — имя в сертификате брокера, если оно отличается от адреса подключения
+	ServerName string `yaml:"server_name"`
+	// InsecureSkipVerify отключает проверку сертификата брокера, только для отладки
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+// enabled сообщает, нужно ли подключаться по TLS
+func (s *TLSSettings) enabled() bool {
+	return s.Enabled || s.CAFile != "" || s.CertFile != ""
+}
+
+// SASLSettings содержит настройки аутентификации SASL
+type SASLSettings struct {
+	// Mechanism — PLAIN, SCRAM-SHA-256 или SCRAM-SHA-512, пусто - без SASL
+	Mechanism string `yaml:"mechanism"`
+	Username  string `yaml:"username"`
+	// Password — пароль. В файлах конфигурации вместо него используйте PasswordFile
+	// или переменную окружения KAFKA_SASL_PASSWORD.
+	Password string `yaml:"password"`
+	// PasswordFile — файл с паролем, например смонтированный секрет. Используется, если Password пуст.
+	PasswordFile string `yaml:"password_file"`
+}
+
+// applySecurity настраивает TLS и SASL клиента. Вызывается для всех конфигураций sarama,
+// поэтому основной, DLQ и транзакционный продюсеры и консьюмер-группа подключаются одинаково.
+func (c *Config) applySecurity(config *sarama.Config) error {
+	if c.TLS.enabled() {
+		tlsConfig, err := c.TLS.config()
+		if err != nil {
+			return err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	if c.SASL.Mechanism == "" {
+		return nil
+	}
+
+	password, err := c.SASL.password()
+	if err != nil {
+		return err
+	}
+
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.User = c.SASL.Username
+	config.Net.SASL.Password = password
+
+	switch strings.ToUpper(c.SASL.Mechanism) {
+	case SASLMechanismPlain:
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case SASLMechanismSCRAMSHA256:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hashGenerator: scram.SHA256}
+		}
+	case SASLMechanismSCRAMSHA512:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hashGenerator: scram.SHA512}
+		}
+	default:
+		return fmt.Errorf("unknown sasl mechanism %q, expected PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512", c.SASL.Mechanism)
+	}
+	return nil
+}
+
+// config загружает сертификаты и создаёт конфигурацию TLS
+func (s *TLSSettings) config() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         s.ServerName,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+	}
+
+	if s.CAFile != "" {
+		ca, err := os.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tls ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in tls ca file %s", s.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if s.CertFile != "" || s.KeyFile != "" {
+		if s.CertFile == "" || s.KeyFile == "" {
+			return nil, fmt.Errorf("tls cert_file and key_file must be set together")
+		}
+		certificate, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// password возвращает пароль SASL из настроек или из PasswordFile
+func (s *SASLSettings) password() (string, error) {
+	if s.Password != "" || s.PasswordFile == "" {
+		return s.Password, nil
+	}
+
+	password, err := os.ReadFile(s.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read sasl password file: %w", err)
+	}
+	// Файлы секретов часто заканчиваются переводом строки
+	return strings.TrimRight(string(password), "\r\n"), nil
+}
+
+// scramClient реализует sarama.SCRAMClient поверх xdg-go/scram
+type scramClient struct {
+	*scram.ClientConversation
+	hashGenerator scram.HashGeneratorFcn
+}
+
+// Begin начинает обмен SCRAM
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.hashGenerator.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.ClientConversation = client.NewConversation()
+	return nil
+}
+
+// Step обрабатывает очередной challenge сервера
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+// Done сообщает, завершён ли обмен
+func (c *scramClient) Done() bool {
+	return c.ClientConversation.Done()
+}
@@ -0,0 +1,144 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+)
+
+// consumerRun — активный запуск Start, который останавливает Shutdown
+type consumerRun struct {
+	group  sarama.ConsumerGroup
+	cancel context.CancelCauseFunc
+	done   chan struct{} // Закрывается, когда Start вернул управление и закрыл консьюмер-группу
+}
+
+// Shutdown плавно останавливает консьюмер:
+//   - перестаёт читать новые сообщения
+//   - дожидается сообщений, которые уже обрабатываются, но не дольше дедлайна ctx
+//   - коммитит отмеченные offset'ы при завершении сессии
+//   - закрывает консьюмер-группу и продюсеры
+//
+// После дедлайна контекст обработчиков отменяется, и Shutdown ждёт их выхода.
+// Start после Shutdown возвращает nil. Повторные вызовы ничего не делают.
+func (c *Consumer) Shutdown(ctx context.Context) error {
+	c.runMu.Lock()
+	first := false
+	c.stopOnce.Do(func() {
+		close(c.stopping)
+		first = true
+	})
+	run := c.run
+	c.runMu.Unlock()
+
+	if !first {
+		return nil
+	}
+
+	started := time.Now()
+	partitions := c.AssignedPartitions()
+	c.logger.WithField("partitions", partitions).Info("Shutting down consumer, draining in-flight messages")
+
+	if run != nil {
+		// Брокеры больше не отдают сообщения; уже полученные, но не начатые,
+		// не коммитятся и будут прочитаны заново
+		run.group.PauseAll()
+
+		drained := make(chan struct{})
+		go func() {
+			c.claims.Wait()
+			close(drained)
+		}()
+
+		select {
+		case <-drained:
+			c.logger.WithFields(logrus.Fields{
+				"partitions": partitions,
+				"duration":   time.Since(started),
+			}).Info("In-flight messages drained")
+		case <-ctx.Done():
+			c.logger.WithError(ctx.Err()).Warn("Shutdown deadline exceeded, interrupting in-flight messages")
+		}
+
+		// Завершение сессии вызывает Cleanup, который коммитит отмеченные offset'ы
+		run.cancel(nil)
+		<-run.done
+	}
+
+	if err := c.closeProducers(); err != nil {
+		return err
+	}
+
+	c.logger.WithField("duration", time.Since(started)).Info("Consumer shut down")
+	return nil
+}
+
+// register запоминает запуск Start для Shutdown. Возвращает false, если консьюмер
+// уже останавливается.
+func (c *Consumer) register(run *consumerRun) bool {
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+
+	if c.isStopping() {
+		return false
+	}
+	c.run = run
+	return true
+}
+
+// isStopping сообщает, вызван ли Shutdown
+func (c *Consumer) isStopping() bool {
+	select {
+	case <-c.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// claimStarted регистрирует партицию, обработку которой дожидается Shutdown.
+// Возвращает false, если консьюмер уже останавливается.
+func (c *Consumer) claimStarted() bool {
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+
+	if c.isStopping() {
+		return false
+	}
+	c.claims.Add(1)
+	return true
+}
+
+// drainClaim сообщает Shutdown, что обработка партиции завершена, и держит партицию
+// до конца сессии: выход из ConsumeClaim завершил бы сессию и прервал обработку
+// сообщений в остальных партициях. inFlight - сколько сообщений дождались завершения,
+// skipped - сколько полученных сообщений не обработаны и будут прочитаны заново.
+func (c *Consumer) drainClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim, drained func(), inFlight, skipped int) error {
+	c.logger.WithFields(logrus.Fields{
+		"topic":     claim.Topic(),
+		"partition": claim.Partition(),
+		"in_flight": inFlight,
+		"skipped":   skipped,
+	}).Info("Partition drained")
+
+	drained()
+	<-session.Context().Done()
+	return nil
+}
+
+// closeProducers закрывает продюсер DLQ и транзакционные продюсеры партиций
+func (c *Consumer) closeProducers() error {
+	var closeErr error
+	if err := c.producer.Close(); err != nil {
+		closeErr = fmt.Errorf("failed to close producer: %w", err)
+	}
+	if c.txnProducers != nil {
+		if err := c.txnProducers.close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
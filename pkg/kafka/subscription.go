@@ -0,0 +1,169 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+)
+
+// topicRefreshInterval — как часто консьюмер с подпиской по шаблону проверяет,
+// не появились ли в кластере новые подходящие топики
+const topicRefreshInterval = time.Minute
+
+// subscription связывает топик или шаблон топиков с обработчиком
+// и собственной цепочкой middleware
+type subscription struct {
+	topic       string
+	pattern     *regexp.Regexp
+	handler     MessageHandler
+	middlewares []Middleware
+}
+
+// Subscribe подписывает консьюмер на топик с отдельным обработчиком. Middleware подписки
+// выполняются после общих middleware консьюмера. Вызывается до Start.
+func (c *Consumer) Subscribe(topic string, handler MessageHandler, middlewares ...Middleware) {
+	c.subscriptions = append(c.subscriptions, &subscription{
+		topic:       topic,
+		handler:     handler,
+		middlewares: middlewares,
+	})
+}
+
+// SubscribePattern подписывает консьюмер на все топики, имя которых целиком совпадает
+// с регулярным выражением, например `auto\..*`. Новые топики подхватываются
+// в течение topicRefreshInterval. Топики повторов, DLQ и служебные топики Kafka
+// в подписку по шаблону не попадают. Явные подписки Subscribe имеют приоритет.
+func (c *Consumer) SubscribePattern(pattern string, handler MessageHandler, middlewares ...Middleware) error {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid topic pattern %q: %w", pattern, err)
+	}
+
+	c.subscriptions = append(c.subscriptions, &subscription{
+		pattern:     re,
+		handler:     handler,
+		middlewares: middlewares,
+	})
+	return nil
+}
+
+// subscriptionFor возвращает подписку для топика: сначала явную, затем первую
+// подходящую по шаблону
+func (c *Consumer) subscriptionFor(topic string) *subscription {
+	for _, sub := range c.subscriptions {
+		if sub.pattern == nil && sub.topic == topic {
+			return sub
+		}
+	}
+	if c.excludedFromPatterns(topic) {
+		return nil
+	}
+	for _, sub := range c.subscriptions {
+		if sub.pattern != nil && sub.pattern.MatchString(topic) {
+			return sub
+		}
+	}
+	return nil
+}
+
+// messageSubscription возвращает подписку, которая обрабатывает сообщение. Сообщения
+// из топиков повторов обрабатываются подпиской топика, из которого прочитаны впервые.
+func (c *Consumer) messageSubscription(message *sarama.ConsumerMessage) (*subscription, error) {
+	topic := originalTopic(message)
+	if sub := c.subscriptionFor(topic); sub != nil {
+		return sub, nil
+	}
+	// Повтор не исправит отсутствие обработчика, сообщение уходит в DLQ
+	return nil, Permanent(fmt.Errorf("no handler subscribed to topic %q", topic))
+}
+
+// hasPatterns проверяет, есть ли подписки по шаблону
+func (c *Consumer) hasPatterns() bool {
+	for _, sub := range c.subscriptions {
+		if sub.pattern != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedFromPatterns проверяет, что топик нельзя подписать по шаблону:
+// это топик повторов или DLQ консьюмера либо служебный топик Kafka
+func (c *Consumer) excludedFromPatterns(topic string) bool {
+	return strings.HasPrefix(topic, "__") || topic == c.config.DLQTopic || c.retryTierIndex(topic) >= 0
+}
+
+// topics возвращает отсортированный список топиков, на которые подписан консьюмер:
+// явные подписки, топики кластера, подходящие под шаблоны, и уровни повторов
+func (c *Consumer) topics(client sarama.Client) ([]string, error) {
+	set := make(map[string]bool)
+	for _, sub := range c.subscriptions {
+		if sub.pattern == nil {
+			set[sub.topic] = true
+		}
+	}
+
+	if c.hasPatterns() {
+		clusterTopics, err := client.Topics()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list topics: %w", err)
+		}
+		for _, topic := range clusterTopics {
+			if c.subscriptionFor(topic) != nil {
+				set[topic] = true
+			}
+		}
+	}
+
+	for _, tier := range c.config.RetryTiers {
+		set[tier.Topic] = true
+	}
+
+	topics := make([]string, 0, len(set))
+	for topic := range set {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// watchTopics периодически обновляет метаданные кластера и вызывает resubscribe,
+// когда список топиков подписки изменился
+func (c *Consumer) watchTopics(ctx context.Context, client sarama.Client, current []string, resubscribe func()) {
+	ticker := time.NewTicker(topicRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := client.RefreshMetadata(); err != nil {
+			c.logger.WithError(err).Warn("Failed to refresh topic metadata")
+			continue
+		}
+
+		topics, err := c.topics(client)
+		if err != nil {
+			c.logger.WithError(err).Warn("Failed to resolve topic subscription")
+			continue
+		}
+
+		if strings.Join(topics, ",") != strings.Join(current, ",") {
+			c.logger.WithFields(logrus.Fields{
+				"previous": current,
+				"topics":   topics,
+			}).Info("Topic subscription changed, rejoining consumer group")
+			resubscribe()
+			return
+		}
+	}
+}
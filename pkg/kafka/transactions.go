@@ -0,0 +1,107 @@
+package kafka
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+)
+
+// PartitionTransactionalID возвращает transactional.id продюсера consume-transform-produce
+// для партиции входного топика. ID постоянный: новый владелец партиции после ребалансировки
+// или перезапуска вытесняет (fence) транзакции прежнего.
+func PartitionTransactionalID(prefix, topic string, partition int32) string {
+	return fmt.Sprintf("%s-%s-%d", prefix, topic, partition)
+}
+
+// topicPartition — партиция топика
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// partitionProducer — транзакционный продюсер одной партиции
+type partitionProducer struct {
+	producer sarama.AsyncProducer
+	mu       sync.Mutex // Транзакции Kafka у продюсера последовательные
+}
+
+// transactionalProducers — транзакционные продюсеры консьюмера, по одному на назначенную
+// партицию. sarama не передаёт поколение группы в AddOffsetsToTxn (KIP-447), поэтому
+// зомби-владельца партиции вытесняет только общий с новым владельцем transactional.id.
+type transactionalProducers struct {
+	config *Config
+	prefix string
+	logger *logrus.Logger
+
+	mu        sync.Mutex
+	producers map[topicPartition]*partitionProducer
+}
+
+// newTransactionalProducers создаёт пустой набор продюсеров. prefix - начало
+// transactional.id, см. PartitionTransactionalID.
+func newTransactionalProducers(config *Config, prefix string, logger *logrus.Logger) *transactionalProducers {
+	return &transactionalProducers{
+		config:    config,
+		prefix:    prefix,
+		logger:    logger,
+		producers: make(map[topicPartition]*partitionProducer),
+	}
+}
+
+// get возвращает продюсер партиции, создавая его при первом обращении в сессии.
+// Создание продюсера получает producer id и вытесняет прежнего владельца партиции.
+func (t *transactionalProducers) get(topic string, partition int32) (*partitionProducer, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := topicPartition{topic: topic, partition: partition}
+	if producer, ok := t.producers[key]; ok {
+		return producer, nil
+	}
+
+	transactionalID := PartitionTransactionalID(t.prefix, topic, partition)
+	txnConfig, err := t.config.TransactionalProducerConfig(transactionalID)
+	if err != nil {
+		return nil, err
+	}
+	txnProducer, err := sarama.NewAsyncProducer(t.config.Brokers, txnConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transactional producer: %w", err)
+	}
+
+	// Ошибки отправки приводят транзакцию в ошибочное состояние и возвращаются из CommitTxn,
+	// здесь каналы результатов только вычитываются
+	go func() {
+		for range txnProducer.Successes() {
+		}
+	}()
+	go func() {
+		for err := range txnProducer.Errors() {
+			t.logger.WithError(err.Err).WithField("topic", err.Msg.Topic).Error("Failed to send transactional message")
+		}
+	}()
+
+	t.logger.WithField("transactional_id", transactionalID).Debug("Transactional producer created")
+
+	producer := &partitionProducer{producer: txnProducer}
+	t.producers[key] = producer
+	return producer, nil
+}
+
+// close закрывает продюсеры всех партиций. Вызывается при завершении сессии:
+// партиции могут перейти другому консьюмеру, и он создаст продюсер с тем же ID.
+func (t *transactionalProducers) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var closeErr error
+	for key, producer := range t.producers {
+		if err := producer.producer.Close(); err != nil && closeErr == nil {
+			closeErr = fmt.Errorf("failed to close transactional producer for %s/%d: %w", key.topic, key.partition, err)
+		}
+		delete(t.producers, key)
+	}
+	return closeErr
+}
@@ -0,0 +1,205 @@
+package kafka
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+)
+
+// workerQueueSize — размер очереди сообщений одного воркера партиции
+const workerQueueSize = 64
+
+// offsetTracker отслеживает обработанные сообщения партиции, которые завершаются
+// не по порядку, и вычисляет offset, до которого все сообщения уже обработаны
+type offsetTracker struct {
+	mu      sync.Mutex
+	pending []int64 // offset'ы выданных воркерам сообщений в порядке чтения
+	done    map[int64]bool
+}
+
+// newOffsetTracker создаёт пустой трекер
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{done: make(map[int64]bool)}
+}
+
+// add регистрирует сообщение, выданное воркеру
+func (t *offsetTracker) add(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending = append(t.pending, offset)
+}
+
+// complete отмечает сообщение обработанным и возвращает offset следующего сообщения
+// после непрерывного префикса обработанных, либо 0, если префикс не сдвинулся.
+// Offset'ы сравниваются по порядку чтения, поэтому пропуски в партиции
+// (транзакционные маркеры, compaction) не мешают сдвигу.
+func (t *offsetTracker) complete(offset int64) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.done[offset] = true
+
+	var next int64
+	for len(t.pending) > 0 && t.done[t.pending[0]] {
+		next = t.pending[0] + 1
+		delete(t.done, t.pending[0])
+		t.pending = t.pending[1:]
+	}
+	return next
+}
+
+// claimWorkers распределяет сообщения одной партиции по воркерам по ключу сообщения.
+// Сообщения с одинаковым ключом (policy_id) обрабатываются одним воркером по порядку.
+type claimWorkers struct {
+	consumer *Consumer
+	session  sarama.ConsumerGroupSession
+	ctx      context.Context
+	cancel   context.CancelFunc
+	queues   []chan *sarama.ConsumerMessage
+	offsets  *offsetTracker
+	commitMu sync.Mutex // Коммиты партиции последовательные, поэтому offset не откатывается
+	errors   chan error
+	wg       sync.WaitGroup
+	active   atomic.Int32 // Сообщения, которые сейчас обрабатываются воркерами
+	stopOnce sync.Once
+}
+
+// newClaimWorkers запускает concurrency воркеров для партиции
+func newClaimWorkers(consumer *Consumer, session sarama.ConsumerGroupSession, concurrency int) *claimWorkers {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(session.Context())
+	w := &claimWorkers{
+		consumer: consumer,
+		session:  session,
+		ctx:      ctx,
+		cancel:   cancel,
+		queues:   make([]chan *sarama.ConsumerMessage, concurrency),
+		offsets:  newOffsetTracker(),
+		errors:   make(chan error, concurrency),
+	}
+
+	for i := range w.queues {
+		w.queues[i] = make(chan *sarama.ConsumerMessage, workerQueueSize)
+		w.wg.Add(1)
+		go w.run(w.queues[i])
+	}
+
+	return w
+}
+
+// dispatch передаёт сообщение воркеру, выбранному по ключу. Блокируется, если
+// очередь воркера заполнена; возвращает false, если воркеры остановлены.
+func (w *claimWorkers) dispatch(message *sarama.ConsumerMessage) bool {
+	queue := w.queues[w.workerIndex(message)]
+	w.offsets.add(message.Offset)
+
+	select {
+	case queue <- message:
+		return true
+	case <-w.ctx.Done():
+		return false
+	}
+}
+
+// workerIndex выбирает воркера по ключу сообщения. Сообщения без ключа
+// распределяются по offset'у: порядок для них не гарантируется.
+func (w *claimWorkers) workerIndex(message *sarama.ConsumerMessage) int {
+	if len(message.Key) == 0 {
+		return int(message.Offset % int64(len(w.queues)))
+	}
+
+	hash := fnv.New32a()
+	hash.Write(message.Key)
+	return int(hash.Sum32() % uint32(len(w.queues)))
+}
+
+// run обрабатывает сообщения очереди по порядку до её закрытия
+func (w *claimWorkers) run(queue <-chan *sarama.ConsumerMessage) {
+	defer w.wg.Done()
+
+	for message := range queue {
+		// После остановки оставшиеся сообщения не обрабатываем: их offset не закоммичен
+		if w.ctx.Err() != nil {
+			continue
+		}
+		// Приостановленный консьюмер не начинает обработку новых сообщений
+		if w.consumer.waitResumed(w.session) != nil {
+			continue
+		}
+
+		w.active.Add(1)
+		outputs, tx, err := w.consumer.handleMessage(w.session, message)
+		if err == nil {
+			err = w.commit(message, outputs, tx)
+		}
+		w.active.Add(-1)
+		if errors.Is(err, errPartitionStopped) {
+			// Сессия уже завершается, ConsumeClaim выйдет сам
+			continue
+		}
+		if err != nil {
+			w.errors <- err
+			w.cancel()
+		}
+	}
+}
+
+// failure возвращает ошибку воркера, из-за которой партиция остановлена
+func (w *claimWorkers) failure() error {
+	select {
+	case err := <-w.errors:
+		return err
+	default:
+		return nil
+	}
+}
+
+// commit последовательно коммитит обработанное сообщение и сдвигает offset партиции
+// до первого необработанного сообщения
+func (w *claimWorkers) commit(message *sarama.ConsumerMessage, outputs []*sarama.ProducerMessage, tx *sql.Tx) error {
+	w.commitMu.Lock()
+	defer w.commitMu.Unlock()
+
+	if err := w.consumer.commitMessage(w.session, message, outputs, tx, w.offsets.complete(message.Offset)); err != nil {
+		w.consumer.logger.WithError(err).WithFields(logrus.Fields{
+			"topic":     message.Topic,
+			"partition": message.Partition,
+			"offset":    message.Offset,
+		}).Error("Failed to commit message, stopping partition until rebalance")
+		return err
+	}
+	return nil
+}
+
+// stop закрывает очереди и дожидается завершения воркеров. Сообщения, которые
+// воркеры уже обрабатывают, обрабатываются до конца, остальные пропускаются.
+func (w *claimWorkers) stop() {
+	w.stopOnce.Do(func() {
+		w.cancel()
+		for _, queue := range w.queues {
+			close(queue)
+		}
+		w.wg.Wait()
+	})
+}
+
+// drain останавливает воркеров, как stop, и возвращает число сообщений, завершения
+// которых пришлось дождаться, и число пропущенных сообщений из очередей
+func (w *claimWorkers) drain() (inFlight, skipped int) {
+	inFlight = int(w.active.Load())
+	for _, queue := range w.queues {
+		skipped += len(queue)
+	}
+	w.stop()
+	return inFlight, skipped
+}
@@ -0,0 +1,103 @@
+package kafka
+
+import "testing"
+
+func TestOffsetTrackerComplete(t *testing.T) {
+	tests := []struct {
+		name     string
+		added    []int64
+		complete []int64
+		want     []int64 // Результат complete для каждого offset'а из complete
+	}{
+		{
+			name:     "in order",
+			added:    []int64{0, 1, 2},
+			complete: []int64{0, 1, 2},
+			want:     []int64{1, 2, 3},
+		},
+		{
+			name:     "out of order",
+			added:    []int64{0, 1, 2},
+			complete: []int64{2, 1, 0},
+			want:     []int64{0, 0, 3},
+		},
+		{
+			name:     "prefix advances up to first pending",
+			added:    []int64{10, 11, 12, 13},
+			complete: []int64{11, 10, 13, 12},
+			want:     []int64{0, 12, 0, 14},
+		},
+		{
+			name:     "gaps in partition offsets",
+			added:    []int64{5, 8, 9, 20},
+			complete: []int64{8, 5, 20, 9},
+			want:     []int64{0, 9, 0, 21},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newOffsetTracker()
+			for _, offset := range tt.added {
+				tracker.add(offset)
+			}
+
+			for i, offset := range tt.complete {
+				if got := tracker.complete(offset); got != tt.want[i] {
+					t.Errorf("complete(%d) = %d, want %d", offset, got, tt.want[i])
+				}
+			}
+
+			if len(tracker.pending) != 0 || len(tracker.done) != 0 {
+				t.Errorf("tracker not empty: pending %v, done %v", tracker.pending, tracker.done)
+			}
+		})
+	}
+}
+
+func TestOffsetTrackerInterleavedAdd(t *testing.T) {
+	tracker := newOffsetTracker()
+	tracker.add(0)
+	tracker.add(1)
+
+	if got := tracker.complete(1); got != 0 {
+		t.Fatalf("complete(1) = %d, want 0", got)
+	}
+
+	// Новые сообщения выдаются воркерам, пока первое ещё обрабатывается
+	tracker.add(2)
+	if got := tracker.complete(2); got != 0 {
+		t.Fatalf("complete(2) = %d, want 0", got)
+	}
+	if got := tracker.complete(0); got != 3 {
+		t.Fatalf("complete(0) = %d, want 3", got)
+	}
+}
+
+func TestConfigValidateConcurrency(t *testing.T) {
+	tests := []struct {
+		name          string
+		concurrency   int
+		offsetStore   bool
+		transactional bool
+		wantErr       bool
+	}{
+		{name: "sequential offset store", concurrency: 1, offsetStore: true},
+		{name: "concurrent plain", concurrency: 10},
+		{name: "concurrent offset store", concurrency: 10, offsetStore: true, wantErr: true},
+		{name: "concurrent transactional", concurrency: 2, transactional: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Concurrency = tt.concurrency
+			config.OffsetStore = tt.offsetStore
+			config.Transactional = tt.transactional
+
+			if err := config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
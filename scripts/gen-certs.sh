@@ -0,0 +1,37 @@
+#!/usr/bin/env bash
+# Генерирует CA, сертификат брокера и клиентский сертификат для docker-compose.tls.yml.
+# Только для локальной проверки mTLS и SASL: ключи не зашифрованы.
+set -euo pipefail
+
+DIR="${1:-certs}"
+DAYS=365
+SASL_PASSWORD="${KAFKA_SASL_PASSWORD:-insurance-secret}"
+
+mkdir -p "$DIR"
+cd "$DIR"
+
+# CA, которым подписаны сертификаты брокера и клиента
+openssl req -x509 -newkey rsa:2048 -nodes -days "$DAYS" \
+  -subj "/CN=kafka-serves-local-ca" -keyout ca.key -out ca.crt
+
+# Сертификат брокера: тот же ключ используется для межброкерских подключений
+openssl req -newkey rsa:2048 -nodes -subj "/CN=kafka-tls" \
+  -keyout kafka.keystore.key -out kafka.csr
+printf "subjectAltName=DNS:localhost,DNS:kafka-tls,IP:127.0.0.1\nextendedKeyUsage=serverAuth,clientAuth\n" > kafka.ext
+openssl x509 -req -in kafka.csr -CA ca.crt -CAkey ca.key -CAcreateserial \
+  -days "$DAYS" -extfile kafka.ext -out kafka.crt
+cat kafka.crt ca.crt > kafka.keystore.pem
+
+# Клиентский сертификат сервисов
+openssl req -newkey rsa:2048 -nodes -subj "/CN=insurance" \
+  -keyout client.key -out client.csr
+printf "extendedKeyUsage=clientAuth\n" > client.ext
+openssl x509 -req -in client.csr -CA ca.crt -CAkey ca.key -CAcreateserial \
+  -days "$DAYS" -extfile client.ext -out client.crt
+
+# Пароль SASL/SCRAM пользователя insurance
+printf '%s\n' "$SASL_PASSWORD" > sasl-password
+
+rm -f ./*.csr ./*.ext ./*.srl
+chmod 600 ./*.key sasl-password
+echo "Certificates written to $(pwd)"
@@ -25,6 +25,44 @@ CREATE TABLE insurance.policy_events (
     kafka_topic VARCHAR(100)
 );
 
+-- Transactional outbox: пишется в одной транзакции с policy_events,
+-- в Kafka сообщения публикует OutboxRelay
+CREATE TABLE insurance.outbox (
+    id BIGSERIAL PRIMARY KEY,
+    event_id UUID NOT NULL UNIQUE,
+    topic VARCHAR(100) NOT NULL,
+    message_key VARCHAR(100),
+    payload BYTEA NOT NULL,
+    headers JSONB NOT NULL DEFAULT '{}',
+    -- Время события: timestamp сообщения в Kafka, а не время записи в outbox
+    message_timestamp TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    sent_at TIMESTAMP WITH TIME ZONE,
+    kafka_partition INTEGER,
+    kafka_offset BIGINT,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT
+);
+
+-- Offset'ы консьюмеров в режиме offset store: сохраняются в одной транзакции
+-- с изменениями обработчика, kafka_offset - offset следующего сообщения
+CREATE TABLE insurance.consumer_offsets (
+    group_id VARCHAR(100) NOT NULL,
+    topic VARCHAR(100) NOT NULL,
+    kafka_partition INTEGER NOT NULL,
+    kafka_offset BIGINT NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (group_id, topic, kafka_partition)
+);
+
+-- Inbox для DedupMiddleware: события, уже обработанные консьюмер-группой
+CREATE TABLE insurance.inbox (
+    consumer_group VARCHAR(100) NOT NULL,
+    event_id VARCHAR(100) NOT NULL,
+    processed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (consumer_group, event_id)
+);
+
 -- Таблица для расчётов премий (Underwriting)
 CREATE TABLE insurance.premium_calculations (
     id UUID PRIMARY KEY,
@@ -54,6 +92,10 @@ CREATE INDEX idx_policies_policy_number ON insurance.policies(policy_number);
 CREATE INDEX idx_policy_events_policy_id ON insurance.policy_events(policy_id);
 CREATE INDEX idx_policy_events_type ON insurance.policy_events(event_type);
 CREATE INDEX idx_policy_events_kafka ON insurance.policy_events(kafka_topic, kafka_partition, kafka_offset);
+CREATE INDEX idx_outbox_unsent ON insurance.outbox(id) WHERE sent_at IS NULL;
+-- Неотправленные записи ключа, которые Producer публикует вместе с новой записью
+CREATE INDEX idx_outbox_unsent_key ON insurance.outbox(message_key, id) WHERE sent_at IS NULL;
+CREATE INDEX idx_inbox_processed_at ON insurance.inbox(processed_at);
 CREATE INDEX idx_premium_calculations_policy_id ON insurance.premium_calculations(policy_id);
 CREATE INDEX idx_billing_records_policy_id ON insurance.billing_records(policy_id);
 CREATE INDEX idx_billing_records_status ON insurance.billing_records(status);
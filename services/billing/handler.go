@@ -3,12 +3,13 @@ package billing
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
 	"github.com/gobulgur/kafka-serves/pkg/kafka"
@@ -16,56 +17,127 @@ import (
 
 // Handler обрабатывает события для биллинга и финансовых операций
 type Handler struct {
+	*kafka.Router
+
 	db     *sql.DB
 	logger *logrus.Logger
 }
 
-// NewHandler создаёт новый handler для billing
-func NewHandler(db *sql.DB, logger *logrus.Logger) *Handler {
-	return &Handler{
+// NewHandler создаёт новый handler для billing. registerer - реестр метрик Router.
+func NewHandler(db *sql.DB, registerer prometheus.Registerer, logger *logrus.Logger) *Handler {
+	h := &Handler{
+		Router: kafka.NewRouter("auto.events", registerer, logger),
 		db:     db,
 		logger: logger,
 	}
+
+	h.On("created", h.handlePolicyCreated)
+	h.On("renewed", h.handlePolicyRenewed)
+	h.On("cancelled", h.handlePolicyCancelled)
+	// В пакете счета за созданные и продлённые полисы сохраняются одним multi-row INSERT
+	h.OnBatch(h.createBillingRecords, "created", "renewed")
+
+	return h
 }
 
-// Handle реализует интерфейс kafka.MessageHandler
-func (h *Handler) Handle(ctx context.Context, message *sarama.ConsumerMessage) error {
-	// Парсим событие
-	var event kafka.PolicyEvent
-	if err := json.Unmarshal(message.Value, &event); err != nil {
-		return fmt.Errorf("failed to unmarshal event: %w", err)
-	}
+// HandleBatch реализует kafka.BatchHandler. Пакет проходит через Router, как и сообщения
+// по одному: созданные и продлённые полисы попадают в createBillingRecords (OnBatch),
+// остальные события - в обработчики своих типов, порядок сохраняется.
+func (h *Handler) HandleBatch(ctx context.Context, messages []*sarama.ConsumerMessage) error {
+	return h.RouteBatch(ctx, messages)
+}
 
-	h.logger.WithFields(logrus.Fields{
-		"event_id":   event.ID,
-		"policy_id":  event.PolicyID,
-		"event_type": event.EventType,
-	}).Info("Processing billing event")
-
-	// Обрабатываем в зависимости от типа события
-	switch event.EventType {
-	case "created":
-		return h.handlePolicyCreated(ctx, &event)
-	case "renewed":
-		return h.handlePolicyRenewed(ctx, &event)
-	case "cancelled":
-		return h.handlePolicyCancelled(ctx, &event)
-	default:
-		h.logger.WithField("event_type", event.EventType).Warn("Unknown event type, skipping")
+// createBillingRecords создаёт счета для созданных и продлённых полисов пакета
+func (h *Handler) createBillingRecords(ctx context.Context, events []*kafka.PolicyEvent) error {
+	if len(events) == 0 {
 		return nil
 	}
+
+	policyIDs := make([]string, 0, len(events))
+	for _, event := range events {
+		policyIDs = append(policyIDs, event.PolicyID)
+	}
+
+	premiums, err := h.latestPremiums(ctx, policyIDs)
+	if err != nil {
+		return err
+	}
+
+	records := make([]*BillingRecord, 0, len(events))
+	for _, event := range events {
+		finalPremium, ok := premiums[event.PolicyID]
+		if !ok {
+			h.logger.WithField("policy_id", event.PolicyID).Warn("Premium not calculated yet, skipping billing")
+			continue
+		}
+
+		dueDate := time.Now().AddDate(0, 0, 30) // 30 дней на оплату
+		if event.EventType == "renewed" {
+			dueDate = time.Now().AddDate(0, 0, 15) // 15 дней на оплату продления
+		}
+
+		records = append(records, &BillingRecord{
+			ID:          uuid.New().String(),
+			PolicyID:    event.PolicyID,
+			Amount:      finalPremium,
+			BillingType: "premium",
+			Status:      "pending",
+			DueDate:     dueDate,
+			CreatedAt:   time.Now(),
+		})
+	}
+
+	if err := h.saveBillingRecords(ctx, records); err != nil {
+		return fmt.Errorf("failed to save billing records: %w", err)
+	}
+
+	for _, record := range records {
+		h.sendPaymentNotification(record)
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"events":  len(events),
+		"records": len(records),
+	}).Info("Billing records created for batch")
+
+	return nil
 }
 
-// GetTopic возвращает топик, который обрабатывает этот handler
-func (h *Handler) GetTopic() string {
-	return "auto.events"
+// latestPremiums возвращает последние рассчитанные премии полисов
+func (h *Handler) latestPremiums(ctx context.Context, policyIDs []string) (map[string]float64, error) {
+	rows, err := kafka.QuerierFromContext(ctx, h.db).QueryContext(ctx, `
+		SELECT DISTINCT ON (policy_id) policy_id, final_premium
+		FROM insurance.premium_calculations
+		WHERE policy_id = ANY($1::uuid[])
+		ORDER BY policy_id, calculated_at DESC`,
+		pq.Array(policyIDs),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get premium calculations: %w", err)
+	}
+	defer rows.Close()
+
+	premiums := make(map[string]float64, len(policyIDs))
+	for rows.Next() {
+		var policyID string
+		var finalPremium float64
+		if err := rows.Scan(&policyID, &finalPremium); err != nil {
+			return nil, fmt.Errorf("failed to scan premium calculation: %w", err)
+		}
+		premiums[policyID] = finalPremium
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read premium calculations: %w", err)
+	}
+
+	return premiums, nil
 }
 
 // handlePolicyCreated создаёт счёт на оплату для нового полиса
 func (h *Handler) handlePolicyCreated(ctx context.Context, event *kafka.PolicyEvent) error {
 	// Получаем рассчитанную премию из базы данных
 	var finalPremium float64
-	err := h.db.QueryRowContext(ctx, `
+	err := kafka.QuerierFromContext(ctx, h.db).QueryRowContext(ctx, `
 		SELECT final_premium 
 		FROM insurance.premium_calculations 
 		WHERE policy_id = $1 
@@ -116,7 +188,7 @@ func (h *Handler) handlePolicyCreated(ctx context.Context, event *kafka.PolicyEv
 func (h *Handler) handlePolicyRenewed(ctx context.Context, event *kafka.PolicyEvent) error {
 	// Получаем новую рассчитанную премию
 	var finalPremium float64
-	err := h.db.QueryRowContext(ctx, `
+	err := kafka.QuerierFromContext(ctx, h.db).QueryRowContext(ctx, `
 		SELECT final_premium 
 		FROM insurance.premium_calculations 
 		WHERE policy_id = $1 
@@ -168,7 +240,7 @@ func (h *Handler) handlePolicyCancelled(ctx context.Context, event *kafka.Policy
 	var lastAmount float64
 	var paidAt sql.NullTime
 
-	err := h.db.QueryRowContext(ctx, `
+	err := kafka.QuerierFromContext(ctx, h.db).QueryRowContext(ctx, `
 		SELECT id, amount, paid_at
 		FROM insurance.billing_records 
 		WHERE policy_id = $1 AND status = 'paid' AND billing_type = 'premium'
@@ -248,7 +320,7 @@ func (h *Handler) saveBillingRecord(ctx context.Context, record *BillingRecord)
 		paidAt = *record.PaidAt
 	}
 
-	_, err := h.db.ExecContext(ctx, `
+	_, err := kafka.QuerierFromContext(ctx, h.db).ExecContext(ctx, `
 		INSERT INTO insurance.billing_records 
 		(id, policy_id, amount, billing_type, status, due_date, created_at, paid_at) 
 		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
@@ -265,6 +337,40 @@ func (h *Handler) saveBillingRecord(ctx context.Context, record *BillingRecord)
 	return err
 }
 
+// saveBillingRecords сохраняет записи о биллинге одним запросом
+func (h *Handler) saveBillingRecords(ctx context.Context, records []*BillingRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	var ids, policyIDs, billingTypes, statuses, dueDates, createdAt []string
+	var amounts []float64
+	for _, record := range records {
+		ids = append(ids, record.ID)
+		policyIDs = append(policyIDs, record.PolicyID)
+		amounts = append(amounts, record.Amount)
+		billingTypes = append(billingTypes, record.BillingType)
+		statuses = append(statuses, record.Status)
+		dueDates = append(dueDates, record.DueDate.Format("2006-01-02"))
+		createdAt = append(createdAt, record.CreatedAt.Format(time.RFC3339Nano))
+	}
+
+	_, err := kafka.QuerierFromContext(ctx, h.db).ExecContext(ctx, `
+		INSERT INTO insurance.billing_records 
+		(id, policy_id, amount, billing_type, status, due_date, created_at) 
+		SELECT * FROM UNNEST($1::uuid[], $2::uuid[], $3::numeric[], $4::text[], $5::text[], $6::date[], $7::timestamptz[])`,
+		pq.Array(ids),
+		pq.Array(policyIDs),
+		pq.Array(amounts),
+		pq.Array(billingTypes),
+		pq.Array(statuses),
+		pq.Array(dueDates),
+		pq.Array(createdAt),
+	)
+
+	return err
+}
+
 // calculateRefund рассчитывает сумму возврата на основе оставшегося времени
 func (h *Handler) calculateRefund(originalAmount float64, paidAt time.Time, cancelledAt time.Time) float64 {
 	// Предполагаем, что полис действует 1 год
@@ -292,7 +398,7 @@ func (h *Handler) processRefund(ctx context.Context, refundRecord *BillingRecord
 
 	// Обновляем статус возврата
 	now := time.Now()
-	_, err := h.db.ExecContext(ctx, `
+	_, err := kafka.QuerierFromContext(ctx, h.db).ExecContext(ctx, `
 		UPDATE insurance.billing_records 
 		SET status = 'paid', paid_at = $1 
 		WHERE id = $2`,
@@ -1,6 +1,8 @@
 package gateway
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"time"
 
@@ -11,6 +13,9 @@ import (
 	"github.com/gobulgur/kafka-serves/pkg/kafka"
 )
 
+// publishTimeout ограничивает ожидание подтверждения от Kafka при публикации события
+const publishTimeout = 10 * time.Second
+
 // Service представляет Gateway сервис
 type Service struct {
 	producer *kafka.Producer
@@ -68,8 +73,16 @@ func (s *Service) CreatePolicy(c *gin.Context) {
 		Timestamp: time.Now(),
 	}
 
-	// Отправляем событие в Kafka
-	if err := s.producer.PublishPolicyEvent(c.Request.Context(), event); err != nil {
+	// Отправляем событие в Kafka и ждём подтверждения
+	ctx, cancel := context.WithTimeout(c.Request.Context(), publishTimeout)
+	defer cancel()
+
+	delivery, err := s.producer.PublishPolicyEvent(ctx, event)
+	if errors.Is(err, kafka.ErrDeliveryPending) {
+		s.acceptPending(c, event, err)
+		return
+	}
+	if err != nil {
 		s.logger.WithError(err).Error("Failed to publish policy created event")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create policy"})
 		return
@@ -79,6 +92,8 @@ func (s *Service) CreatePolicy(c *gin.Context) {
 		"policy_id": policyID,
 		"client_id": req.ClientID,
 		"event_id":  event.ID,
+		"partition": delivery.Partition,
+		"offset":    delivery.Offset,
 	}).Info("Policy creation event published")
 
 	c.JSON(http.StatusCreated, gin.H{
@@ -143,8 +158,16 @@ func (s *Service) RenewPolicy(c *gin.Context) {
 		Timestamp: time.Now(),
 	}
 
-	// Отправляем событие в Kafka
-	if err := s.producer.PublishPolicyEvent(c.Request.Context(), event); err != nil {
+	// Отправляем событие в Kafka и ждём подтверждения
+	ctx, cancel := context.WithTimeout(c.Request.Context(), publishTimeout)
+	defer cancel()
+
+	delivery, err := s.producer.PublishPolicyEvent(ctx, event)
+	if errors.Is(err, kafka.ErrDeliveryPending) {
+		s.acceptPending(c, event, err)
+		return
+	}
+	if err != nil {
 		s.logger.WithError(err).Error("Failed to publish policy renewed event")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to renew policy"})
 		return
@@ -153,6 +176,8 @@ func (s *Service) RenewPolicy(c *gin.Context) {
 	s.logger.WithFields(logrus.Fields{
 		"policy_id": policyID,
 		"event_id":  event.ID,
+		"partition": delivery.Partition,
+		"offset":    delivery.Offset,
 	}).Info("Policy renewal event published")
 
 	c.JSON(http.StatusOK, gin.H{
@@ -183,8 +208,16 @@ func (s *Service) CancelPolicy(c *gin.Context) {
 		Timestamp: time.Now(),
 	}
 
-	// Отправляем событие в Kafka
-	if err := s.producer.PublishPolicyEvent(c.Request.Context(), event); err != nil {
+	// Отправляем событие в Kafka и ждём подтверждения
+	ctx, cancel := context.WithTimeout(c.Request.Context(), publishTimeout)
+	defer cancel()
+
+	delivery, err := s.producer.PublishPolicyEvent(ctx, event)
+	if errors.Is(err, kafka.ErrDeliveryPending) {
+		s.acceptPending(c, event, err)
+		return
+	}
+	if err != nil {
 		s.logger.WithError(err).Error("Failed to publish policy cancelled event")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel policy"})
 		return
@@ -193,6 +226,8 @@ func (s *Service) CancelPolicy(c *gin.Context) {
 	s.logger.WithFields(logrus.Fields{
 		"policy_id": policyID,
 		"event_id":  event.ID,
+		"partition": delivery.Partition,
+		"offset":    delivery.Offset,
 	}).Info("Policy cancellation event published")
 
 	c.JSON(http.StatusOK, gin.H{
@@ -202,6 +237,22 @@ func (s *Service) CancelPolicy(c *gin.Context) {
 	})
 }
 
+// acceptPending отвечает 202 на запрос, событие которого сохранено, но ещё не доставлено
+// в Kafka: его доставит OutboxRelay, и повтор запроса создал бы второе событие
+func (s *Service) acceptPending(c *gin.Context, event *kafka.PolicyEvent, err error) {
+	s.logger.WithError(err).WithFields(logrus.Fields{
+		"policy_id":  event.PolicyID,
+		"event_id":   event.ID,
+		"event_type": event.EventType,
+	}).Warn("Policy event stored, delivery to Kafka pending")
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"policy_id": event.PolicyID,
+		"event_id":  event.ID,
+		"status":    "pending",
+	})
+}
+
 // GetPolicy возвращает информацию о полисе
 func (s *Service) GetPolicy(c *gin.Context) {
 	policyID := c.Param("id")
@@ -10,56 +10,36 @@ import (
 
 	"github.com/Shopify/sarama"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
 	"github.com/gobulgur/kafka-serves/pkg/kafka"
 )
 
+// premiumEventsTopic — топик событий о рассчитанных премиях
+const premiumEventsTopic = "premium.events"
+
 // Handler обрабатывает события для расчёта страховых премий
 type Handler struct {
+	*kafka.Router
+
 	db     *sql.DB
 	logger *logrus.Logger
 }
 
-// NewHandler создаёт новый handler для underwriting
-func NewHandler(db *sql.DB, logger *logrus.Logger) *Handler {
-	return &Handler{
+// NewHandler создаёт новый handler для underwriting. registerer - реестр метрик Router.
+func NewHandler(db *sql.DB, registerer prometheus.Registerer, logger *logrus.Logger) *Handler {
+	h := &Handler{
+		Router: kafka.NewRouter("auto.events", registerer, logger),
 		db:     db,
 		logger: logger,
 	}
-}
-
-// Handle реализует интерфейс kafka.MessageHandler
-func (h *Handler) Handle(ctx context.Context, message *sarama.ConsumerMessage) error {
-	// Парсим событие
-	var event kafka.PolicyEvent
-	if err := json.Unmarshal(message.Value, &event); err != nil {
-		return fmt.Errorf("failed to unmarshal event: %w", err)
-	}
 
-	h.logger.WithFields(logrus.Fields{
-		"event_id":   event.ID,
-		"policy_id":  event.PolicyID,
-		"event_type": event.EventType,
-	}).Info("Processing underwriting event")
-
-	// Обрабатываем в зависимости от типа события
-	switch event.EventType {
-	case "created":
-		return h.handlePolicyCreated(ctx, &event)
-	case "renewed":
-		return h.handlePolicyRenewed(ctx, &event)
-	case "cancelled":
-		return h.handlePolicyCancelled(ctx, &event)
-	default:
-		h.logger.WithField("event_type", event.EventType).Warn("Unknown event type, skipping")
-		return nil
-	}
-}
+	h.On("created", h.handlePolicyCreated)
+	h.On("renewed", h.handlePolicyRenewed)
+	h.On("cancelled", h.handlePolicyCancelled)
 
-// GetTopic возвращает топик, который обрабатывает этот handler
-func (h *Handler) GetTopic() string {
-	return "auto.events"
+	return h
 }
 
 // handlePolicyCreated обрабатывает создание нового полиса
@@ -67,7 +47,7 @@ func (h *Handler) handlePolicyCreated(ctx context.Context, event *kafka.PolicyEv
 	// Извлекаем данные полиса из события
 	policyData, ok := event.EventData["policy"].(map[string]interface{})
 	if !ok {
-		return fmt.Errorf("invalid policy data in event")
+		return kafka.Permanent(fmt.Errorf("invalid policy data in event"))
 	}
 
 	// Рассчитываем премию на основе факторов риска
@@ -77,7 +57,7 @@ func (h *Handler) handlePolicyCreated(ctx context.Context, event *kafka.PolicyEv
 	}
 
 	// Сохраняем расчёт в базу данных
-	_, err = h.db.ExecContext(ctx, `
+	_, err = kafka.QuerierFromContext(ctx, h.db).ExecContext(ctx, `
 		INSERT INTO insurance.premium_calculations 
 		(id, policy_id, base_premium, risk_factors, final_premium, calculated_at, calculation_version) 
 		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
@@ -94,6 +74,10 @@ func (h *Handler) handlePolicyCreated(ctx context.Context, event *kafka.PolicyEv
 		return fmt.Errorf("failed to save premium calculation: %w", err)
 	}
 
+	if err := h.emitPremiumCalculated(ctx, event, calculation, 1); err != nil {
+		return err
+	}
+
 	h.logger.WithFields(logrus.Fields{
 		"policy_id":     event.PolicyID,
 		"base_premium":  calculation.BasePremium,
@@ -109,12 +93,12 @@ func (h *Handler) handlePolicyRenewed(ctx context.Context, event *kafka.PolicyEv
 	// При продлении пересчитываем премию с учётом новых данных
 	policyData, ok := event.EventData["policy"].(map[string]interface{})
 	if !ok {
-		return fmt.Errorf("invalid policy data in event")
+		return kafka.Permanent(fmt.Errorf("invalid policy data in event"))
 	}
 
 	// Получаем предыдущую версию расчёта
 	var previousVersion int
-	err := h.db.QueryRowContext(ctx,
+	err := kafka.QuerierFromContext(ctx, h.db).QueryRowContext(ctx,
 		"SELECT COALESCE(MAX(calculation_version), 0) FROM insurance.premium_calculations WHERE policy_id = $1",
 		event.PolicyID,
 	).Scan(&previousVersion)
@@ -130,7 +114,7 @@ func (h *Handler) handlePolicyRenewed(ctx context.Context, event *kafka.PolicyEv
 	}
 
 	// Сохраняем новый расчёт
-	_, err = h.db.ExecContext(ctx, `
+	_, err = kafka.QuerierFromContext(ctx, h.db).ExecContext(ctx, `
 		INSERT INTO insurance.premium_calculations 
 		(id, policy_id, base_premium, risk_factors, final_premium, calculated_at, calculation_version) 
 		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
@@ -147,6 +131,10 @@ func (h *Handler) handlePolicyRenewed(ctx context.Context, event *kafka.PolicyEv
 		return fmt.Errorf("failed to save renewed premium calculation: %w", err)
 	}
 
+	if err := h.emitPremiumCalculated(ctx, event, calculation, previousVersion+1); err != nil {
+		return err
+	}
+
 	h.logger.WithFields(logrus.Fields{
 		"policy_id":           event.PolicyID,
 		"calculation_version": previousVersion + 1,
@@ -169,6 +157,50 @@ func (h *Handler) handlePolicyCancelled(ctx context.Context, event *kafka.Policy
 	return nil
 }
 
+// emitPremiumCalculated публикует событие premium_calculated. В транзакционном режиме
+// консьюмера оно коммитится вместе с offset'ом исходного события
+func (h *Handler) emitPremiumCalculated(ctx context.Context, event *kafka.PolicyEvent, calculation *PremiumCalculation, version int) error {
+	premiumEvent := &kafka.PolicyEvent{
+		// ID детерминирован: повторная обработка исходного события даёт тот же event_id
+		ID:        uuid.NewSHA1(uuid.NameSpaceOID, []byte(fmt.Sprintf("%s/premium/%d", event.ID, version))).String(),
+		PolicyID:  event.PolicyID,
+		EventType: "premium_calculated",
+		EventData: map[string]interface{}{
+			"base_premium":        calculation.BasePremium,
+			"risk_score":          calculation.RiskScore,
+			"risk_factors":        calculation.RiskFactors,
+			"final_premium":       calculation.FinalPremium,
+			"calculation_version": version,
+			"source_event_id":     event.ID,
+		},
+		Timestamp: time.Now(),
+		Source:    "underwriting",
+		Version:   "1.0",
+	}
+
+	premiumBytes, err := json.Marshal(premiumEvent)
+	if err != nil {
+		return fmt.Errorf("failed to marshal premium event: %w", err)
+	}
+
+	err = kafka.Emit(ctx, &sarama.ProducerMessage{
+		Topic: premiumEventsTopic,
+		Key:   sarama.StringEncoder(event.PolicyID),
+		Value: sarama.ByteEncoder(premiumBytes),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("event_id"), Value: []byte(premiumEvent.ID)},
+			{Key: []byte("event_type"), Value: []byte(premiumEvent.EventType)},
+			{Key: []byte("source"), Value: []byte(premiumEvent.Source)},
+		},
+		Timestamp: premiumEvent.Timestamp,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to emit premium event: %w", err)
+	}
+
+	return nil
+}
+
 // PremiumCalculation представляет результат расчёта премии
 type PremiumCalculation struct {
 	BasePremium     float64